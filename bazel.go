@@ -0,0 +1,146 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filecache
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// WithBazel adds (iff enable) the endpoints of the Bazel remote HTTP cache protocol to the Handler:
+//
+//	/ac/<hash>   GET, HEAD and PUT the action result of the action with the hex SHA-256 digest
+//	/cas/<hash>  GET, HEAD and PUT the content with the hex SHA-256 digest
+//
+// The action results are stored with the digest as ActionID.
+// The content is stored with the digest as OutputID (a PUT with another content is refused),
+// under an ActionID derived from it (see BazelCASActionID), as the digest of an action
+// may be in the CAS, too.
+func WithBazel(enable bool) handlerOption {
+	return func(h *handler) { h.bazel = enable }
+}
+
+// BazelCASActionID returns the ActionID the content with the OutputID out is stored under,
+// by a PUT to /cas/<hash> (see WithBazel).
+func BazelCASActionID(out OutputID) ActionID {
+	return NewActionID(append([]byte("bazel-cas\x00"), out[:]...))
+}
+
+// bazelKey decodes the hash path value, returning the ActionID to store it under,
+// and for the CAS, the OutputID of the content.
+func bazelKey(r *http.Request, cas bool) (ActionID, OutputID, error) {
+	var out OutputID
+	s := r.PathValue("hash")
+	if hex.DecodedLen(len(s)) != len(out) {
+		return ActionID{}, out, fmt.Errorf("%q: not a hex SHA-256 digest", s)
+	}
+	if _, err := hex.Decode(out[:], []byte(s)); err != nil {
+		return ActionID{}, out, fmt.Errorf("%q: %w", s, err)
+	}
+	if cas {
+		return BazelCASActionID(out), out, nil
+	}
+	return ActionID(out), out, nil
+}
+
+// bazelGet serves a GET (or HEAD) /ac/<hash> or /cas/<hash> request.
+func (h *handler) bazelGet(cas bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, out, err := bazelKey(r, cas)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger := h.C.logger.With("path", r.URL.Path)
+		rc, entry, err := h.C.getReaderContext(r.Context(), id)
+		if err == nil && cas && entry.OutputID != out {
+			rc.Close()
+			err = fmt.Errorf("%w: content mismatch", ErrCorrupt)
+		}
+		if err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, ErrNotFound) || errors.Is(err, ErrCorrupt) {
+				code = http.StatusNotFound
+			} else {
+				logger.Error("GetReader", "error", err)
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		defer rc.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+		if r.Method == "HEAD" {
+			return
+		}
+		if _, err := io.Copy(w, rc); err != nil {
+			logger.Error("serve", "error", err)
+		}
+	}
+}
+
+// bazelPut stores the body of a PUT /ac/<hash> or /cas/<hash> request.
+func (h *handler) bazelPut(cas bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, out, err := bazelKey(r, cas)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger := h.C.logger.With("path", r.URL.Path)
+		if h.maxUpload > 0 {
+			if r.ContentLength > h.maxUpload {
+				http.Error(w, (&http.MaxBytesError{Limit: h.maxUpload}).Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, h.maxUpload)
+		}
+		var body io.Reader = r.Body
+		if cas {
+			body = &digestReader{r: body, h: NewHash(), want: out}
+		}
+		_, n, err := h.C.putReaderContext(r.Context(), id, body)
+		logger.Info("put", "length", n, "error", err)
+		if err != nil {
+			code := http.StatusInternalServerError
+			var tooLarge *http.MaxBytesError
+			if errors.Is(err, errDigestMismatch) {
+				code = http.StatusBadRequest
+			} else if errors.Is(err, ErrNoSpace) {
+				code = http.StatusInsufficientStorage
+			} else if errors.As(err, &tooLarge) {
+				code = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+var errDigestMismatch = errors.New("content digest mismatch")
+
+// digestReader reads r, returning errDigestMismatch instead of io.EOF
+// if the content's digest is not want - so mismatching content is not stored.
+type digestReader struct {
+	r    io.Reader
+	h    Hash
+	want OutputID
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	dr.h.Write(p[:n])
+	if err == io.EOF {
+		if got := dr.h.SumOutputID(); got != dr.want {
+			return n, fmt.Errorf("%w: got %x", errDigestMismatch, got)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,98 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// BlobStore is a (remote, larger) store of the outputs, keyed by the action IDs,
+// the second tier of the cache (see WithBlobStore).
+//
+// It can be implemented over S3, GCS, MinIO, or any other object storage.
+type BlobStore interface {
+	// Get returns the content stored for the action ID,
+	// or an error wrapping ErrNotFound if there is none.
+	Get(ctx context.Context, id ActionID) (io.ReadCloser, error)
+	// Put stores the size bytes read from r for the action ID.
+	Put(ctx context.Context, id ActionID, r io.Reader, size int64) error
+	// Head reports whether there is content stored for the action ID.
+	Head(ctx context.Context, id ActionID) (bool, error)
+}
+
+// blobUploadTimeout is the time limit of an upload to the BlobStore.
+const blobUploadTimeout = 10 * time.Minute
+
+// WithBlobStore sets the second tier of the cache.
+//
+// On a local miss, the Get* methods (as with WithSource) fetch the entry from bs,
+// store it locally and serve it from the cache - so the entries trimmed locally
+// are still available from bs. WithSource is only called on a miss of bs, too.
+//
+// The entries stored locally are uploaded to bs asynchronously
+// (except the ones with an expiry, see PutWithExpiry); Close waits for the uploads.
+// The upload errors are only logged.
+func WithBlobStore(bs BlobStore) cacheOption {
+	return func(C *Cache) { C.blobs = bs }
+}
+
+// fetch returns the content of the action ID from the BlobStore, or the source.
+func (C *Cache) fetch(ctx context.Context, id ActionID) (io.ReadCloser, error) {
+	if C.blobs != nil {
+		rc, err := C.blobs.Get(ctx, id)
+		if err == nil || C.source == nil {
+			return rc, err
+		}
+		if !errors.Is(err, ErrNotFound) {
+			C.logger.Warn("blob store get", "actionID", fmt.Sprintf("%x", id), "error", err)
+		}
+	}
+	return C.source(ctx, id)
+}
+
+// stored counts a successful store of the action ID, and starts its upload to the BlobStore.
+func (C *Cache) stored(id ActionID) {
+	C.metrics.puts.Add(1)
+	if C.blobs == nil {
+		return
+	}
+	C.uploads.Add(1)
+	go func() {
+		defer C.uploads.Done()
+		if err := C.upload(id); err != nil {
+			C.logger.Warn("blob store upload", "actionID", fmt.Sprintf("%x", id), "error", err)
+		}
+	}()
+}
+
+// upload puts the entry of the action ID to the BlobStore, if it is not there yet.
+func (C *Cache) upload(id ActionID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), blobUploadTimeout)
+	defer cancel()
+	// Wait for the Put to finish, with the expiry.
+	mu := C.shard(id)
+	mu.Lock()
+	_, err := os.Stat(C.fileName(id, "e"))
+	mu.Unlock()
+	if err == nil {
+		return nil
+	}
+	if ok, err := C.blobs.Head(ctx, id); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+	rc, entry, err := C.getReader(id)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return C.blobs.Put(ctx, id, rc, entry.Size)
+}
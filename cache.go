@@ -7,18 +7,32 @@ package filecache
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/google/renameio/v2"
 	"github.com/rogpeppe/go-internal/cache"
 	"github.com/rogpeppe/go-internal/lockedfile"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 // An ActionID is a cache action key, the hash of a complete description of a
@@ -31,11 +45,49 @@ type OutputID = cache.OutputID
 
 func NewActionID(p []byte) ActionID { return ActionID(SumID(p)) }
 
+// DecodeActionID decodes the base64 (URL encoding) ActionID,
+// as it is in the paths of the Handler.
+func DecodeActionID(actionIDb64 string) (ActionID, error) {
+	var actionID ActionID
+	b, err := base64.URLEncoding.DecodeString(actionIDb64)
+	if err != nil {
+		return actionID, fmt.Errorf("decode %q: %w", actionIDb64, err)
+	}
+	if len(b) != len(actionID) {
+		return actionID, fmt.Errorf("size mismatch: got %q (%d) wanted %d", actionIDb64, len(b), len(actionID))
+	}
+	copy(actionID[:], b)
+	return actionID, nil
+}
+
+// NewActionIDWith returns the ActionID of p, hashed with h instead of SHA-256.
+//
+// ActionID is a HashSize (32) bytes long array (as required by the underlying cache),
+// so a longer digest is truncated, and a shorter one is zero padded.
+func NewActionIDWith(h func() hash.Hash, p []byte) ActionID {
+	hsh := HashWith(h)
+	hsh.Write(p)
+	return hsh.SumActionID()
+}
+
+var (
+	// ErrNotFound is returned when the cache entry is not found.
+	ErrNotFound = errors.New("not found")
+	// ErrCorrupt is returned when the data file does not match its OutputID.
+	ErrCorrupt = errors.New("corrupt cache entry")
+	// ErrNoSpace is returned by the Put methods when the disk is full,
+	// even after trimming the cache. It wraps the original (syscall.ENOSPC) error.
+	ErrNoSpace = errors.New("no space left for the cache")
+)
+
 const (
 	DefaultMaxSize      = 0
+	DefaultMaxCount     = 0
 	DefaultTrimInterval = 5 * time.Minute
 	DefaultTrimLimit    = 24 * time.Hour
 	DefaultTrimSize     = 100 << 20
+	// DefaultCopyBufferSize is the size of the buffers the copies use, as io.Copy's.
+	DefaultCopyBufferSize = 32 << 10
 )
 
 // A Cache is a package cache, backed by a file system directory tree.
@@ -44,12 +96,51 @@ type Cache struct {
 	c        *cache.Cache
 	now      func() time.Time
 
-	dir                     string
+	dir, tempDir            string
+	codec, cipher           Codec
+	verifyOnGet, touchOnGet bool
 	trimSize, maxSize       int64
+	maxCount                int64
 	trimInterval, trimLimit time.Duration
+	maxAge                  time.Duration
 	logger                  *slog.Logger
+	autoTrimCtx             context.Context
+	stopTrimmer             context.CancelFunc
+	trimmerDone             chan struct{}
+	onEvict                 func(ActionID, OutputID, int64)
+	source                  func(ctx context.Context, id ActionID) (io.ReadCloser, error)
+	tracer                  trace.Tracer
+	blobs                   BlobStore
+	evicted                 []evicted
+
+	group   singleflight.Group
+	uploads sync.WaitGroup
+	// pins are the reference counts of the cache files pinned by Acquire, by base name.
+	pins    map[string]int
+	pinsMu  sync.Mutex
+	metrics metrics
+
+	// bufs is the pool of the copy buffers, of copyBufSize.
+	copyBufSize int
+	bufs        sync.Pool
 
-	mu sync.Mutex
+	// trimSubdirs is the number of subdirectories to scan in one trim (0 means all),
+	// starting at trimCursor.
+	trimSubdirs int
+	// trimCursor, subdirSize and subdirCount are guarded by trimMu.
+	// subdirSize and subdirCount are the size of the cache files and the number of the data files
+	// in each subdirectory, as seen by their last trim.
+	trimCursor              int
+	subdirSize, subdirCount [256]int64
+
+	// trimCounts is guarded by trimMu (its counters are atomic for the parallel trim workers).
+	trimCounts trimCounts
+
+	// trimMu serializes trims, and guards lastTrim and evicted.
+	trimMu    sync.Mutex
+	evictedMu sync.Mutex
+	// shards serialize the operations on the action IDs, by their first byte.
+	shards [256]sync.Mutex
 }
 type cacheOption func(*Cache)
 
@@ -61,6 +152,20 @@ func WithMaxSize(n int64) cacheOption {
 		C.maxSize = n
 	}
 }
+
+// WithMaxCount limits the number of data files in the cache:
+// on trim, the oldest files are evicted till there are at most n remaining.
+//
+// This is independent of WithMaxSize: whichever limit is hit first triggers eviction.
+// Zero means no limit.
+func WithMaxCount(n int64) cacheOption {
+	return func(C *Cache) {
+		if n < 0 {
+			n = DefaultMaxCount
+		}
+		C.maxCount = n
+	}
+}
 func WithNow(f func() time.Time) cacheOption {
 	return func(C *Cache) {
 		if f != nil {
@@ -68,6 +173,9 @@ func WithNow(f func() time.Time) cacheOption {
 		}
 	}
 }
+
+// WithTrimSize sets the size above which the cache files are removed
+// if they are older than the trim interval, regardless of the max age.
 func WithTrimSize(n int64) cacheOption {
 	return func(C *Cache) {
 		if n < 0 {
@@ -84,6 +192,9 @@ func WithTrimInterval(d time.Duration) cacheOption {
 		C.trimInterval = d
 	}
 }
+
+// WithTrimLimit sets the age after which the cache files not used
+// (with WithTouchOnGet, not read) are removed.
 func WithTrimLimit(d time.Duration) cacheOption {
 	return func(C *Cache) {
 		if d < 0 {
@@ -93,6 +204,126 @@ func WithTrimLimit(d time.Duration) cacheOption {
 	}
 }
 
+// WithMaxAge sets the age (since their Put) after which the entries are removed on trim,
+// however recently they have been used.
+//
+// This is independent of the trim limit (WithTrimLimit), which removes the cache files
+// not used for that long, and of the size limit (WithTrimSize): a cache file bigger
+// than that is removed once it is older than the trim interval, even if
+// it is younger than the max age.
+// Only the action entries are removed for their age, as the data files may be shared:
+// those are removed by the trim limit once unused.
+// Zero means no max age.
+func WithMaxAge(d time.Duration) cacheOption {
+	return func(C *Cache) {
+		if d < 0 {
+			d = 0
+		}
+		C.maxAge = d
+	}
+}
+
+// WithIncrementalTrim makes each trim scan only the next subdirsPerRun of the
+// 256 subdirectories, round robin (the position is kept in trim.txt),
+// so a trim of a huge cache does not cause a latency spike for the Put triggering it.
+//
+// The whole cache is covered only over several trims, so the size and count limits
+// (WithMaxSize, WithMaxCount) become approximate: they are checked against
+// the sizes seen by the last scan of each subdirectory.
+// Zero (or 256 and above) means scanning all subdirectories in each trim.
+func WithIncrementalTrim(subdirsPerRun int) cacheOption {
+	return func(C *Cache) {
+		if subdirsPerRun < 0 {
+			subdirsPerRun = 0
+		}
+		C.trimSubdirs = subdirsPerRun
+	}
+}
+
+// WithEvictCallback sets a function to be called for each entry removed by trim.
+//
+// fn is called for each action entry removed, with its ActionID and OutputID,
+// and the size of its data file, if that is removed, too (zero otherwise,
+// as the data file is shared by other actions, or is younger).
+// As data files are named after their content, an output may be shared by several actions:
+// its size is passed with the first of them only, so the sizes add up to the removed bytes.
+// The size and count limits (WithMaxSize, WithMaxCount) remove a data file
+// with all the action entries pointing at it, so those are reported with their ActionIDs, too.
+// Only for a data file removed without any of its action entries (as it had none,
+// or they are younger than the trim limit) is fn called with a zero ActionID.
+//
+// The callback is called without holding the cache's locks,
+// so it may call the cache's methods.
+func WithEvictCallback(fn func(id ActionID, out OutputID, size int64)) cacheOption {
+	return func(C *Cache) { C.onEvict = fn }
+}
+
+// WithAutoTrim starts a background goroutine which trims the cache
+// at every trim interval, till ctx is cancelled or the Cache is closed - iff ctx is not nil.
+func WithAutoTrim(ctx context.Context) cacheOption {
+	return func(C *Cache) { C.autoTrimCtx = ctx }
+}
+
+// WithCompression compresses the data files with the given codec.
+//
+// The OutputID is still the hash of the uncompressed content,
+// and the data files stored without compression (or with another known codec) are still readable.
+func WithCompression(codec Codec) cacheOption {
+	return func(C *Cache) { C.codec = codec }
+}
+
+// WithEncryption encrypts the data files with AES-256-GCM, using the given key.
+//
+// The ActionID and OutputID are computed over the plaintext,
+// so lookups are deterministic with the same key.
+// Reading a data file encrypted with another key fails with ErrAuthentication.
+func WithEncryption(key [32]byte) cacheOption {
+	return func(C *Cache) { C.cipher = newAESGCMCodec(key) }
+}
+
+// WithVerifyOnGet makes GetFile, GetBytes and GetReader re-hash the data file,
+// and return ErrCorrupt (deleting the entry) if it does not match its OutputID.
+func WithVerifyOnGet(verify bool) cacheOption {
+	return func(C *Cache) { C.verifyOnGet = verify }
+}
+
+// WithTouchOnGet makes GetFile refresh the modification time of the entry (see Touch),
+// so trimming removes the least recently used entries, not just the oldest ones.
+func WithTouchOnGet(touch bool) cacheOption {
+	return func(C *Cache) { C.touchOnGet = touch }
+}
+
+// WithCopyBufferSize sets the size of the pooled buffers used for copying the content
+// (DefaultCopyBufferSize); larger ones may help with large entries.
+func WithCopyBufferSize(size int) cacheOption {
+	return func(C *Cache) {
+		if size > 0 {
+			C.copyBufSize = size
+		}
+	}
+}
+
+// WithTempDir sets the directory of the temporary files written by PutReader and Import.
+//
+// By default it is the tmp subdirectory of the cache directory, so the finished file
+// is renamed into place: with a directory on another file system, it is copied.
+// Trim removes the files of the default directory left behind (by crashed processes, for example),
+// not modified within the trim limit; it does not touch another directory set here.
+func WithTempDir(dir string) cacheOption {
+	return func(C *Cache) { C.tempDir = dir }
+}
+
+// WithSource sets the source of the entries missing from the cache:
+// on a miss, GetBytes, GetFile, GetReader and GetEncodedReader call fn for the content,
+// store it, and return it from the cache.
+// Concurrent misses of the same action ID call fn only once.
+//
+// If fn returns an error wrapping ErrNotFound, it is a miss.
+// Get and Has only look at the cache, they do not call fn.
+func WithSource(fn func(ctx context.Context, id ActionID) (io.ReadCloser, error)) cacheOption {
+	return func(C *Cache) { C.source = fn }
+}
+
 // WithLogger sets the logger to the given Logger - iff it is not nil.
 func WithLogger(lgr *slog.Logger) cacheOption {
 	return func(C *Cache) {
@@ -120,177 +351,1917 @@ func Open(dir string, options ...cacheOption) (*Cache, error) {
 	}
 	C := &Cache{c: c, now: time.Now, dir: dir,
 		maxSize:      DefaultMaxSize,
+		maxCount:     DefaultMaxCount,
 		trimInterval: DefaultTrimInterval,
 		trimLimit:    DefaultTrimLimit,
 		trimSize:     DefaultTrimSize,
+		copyBufSize:  DefaultCopyBufferSize,
 		logger:       slog.Default().With("lib", "filecache"),
 	}
 	for _, o := range options {
 		o(C)
 	}
+	if C.tempDir == "" {
+		C.tempDir = filepath.Join(dir, "tmp")
+	}
+	if err := os.MkdirAll(C.tempDir, 0777); err != nil {
+		return nil, err
+	}
+	C.bufs.New = func() any {
+		b := make([]byte, C.copyBufSize)
+		return &b
+	}
+	if C.autoTrimCtx != nil {
+		C.startTrimmer(C.autoTrimCtx)
+	}
 	return C, nil
 }
 
+// Close stops the background trimmer (if started with WithAutoTrim),
+// and waits for it, and the uploads to the BlobStore (see WithBlobStore) to finish.
+func (C *Cache) Close() error {
+	if C.stopTrimmer != nil {
+		C.stopTrimmer()
+		<-C.trimmerDone
+	}
+	C.uploads.Wait()
+	return nil
+}
+
+func (C *Cache) startTrimmer(ctx context.Context) {
+	ctx, C.stopTrimmer = context.WithCancel(ctx)
+	C.trimmerDone = make(chan struct{})
+	interval := C.trimInterval
+	if interval <= 0 {
+		interval = DefaultTrimInterval
+	}
+	go func() {
+		defer close(C.trimmerDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// Trim holds the trim lock, so this does not race with the trims in Put.
+				if err := C.Trim(); err != nil {
+					C.logger.Error("auto trim", "error", err)
+				}
+			}
+		}
+	}()
+}
+
 // Put stores the given output in the cache as the output for the action ID.
 // It may read file twice. The content of file must not change between the two passes.
+// Use PutReader for content that can be read only once.
+//
+// If the disk is full, the cache is trimmed right away and the put is tried once more;
+// if that fails too, the error wraps ErrNoSpace. This holds for all the Put methods.
 func (C *Cache) Put(id ActionID, file io.ReadSeeker) (OutputID, int64, error) {
-	C.mu.Lock()
-	defer C.mu.Unlock()
-	C.trim()
-	return C.c.Put(id, file)
+	return C.PutContext(context.Background(), id, file)
 }
 
-// Get looks up the action ID in the cache,
-// returning the corresponding output ID and file size, if any.
-// Note that finding an output ID does not guarantee that the
-// saved file for that output ID is still available.
-func (C *Cache) Get(id ActionID) (cache.Entry, error) {
-	C.mu.Lock()
-	defer C.mu.Unlock()
-	return C.c.Get(id)
+// PutContext is like Put, but aborts the copy when ctx is cancelled.
+func (C *Cache) PutContext(ctx context.Context, id ActionID, file io.ReadSeeker) (out OutputID, n int64, err error) {
+	ctx, span := C.startSpan(ctx, "filecache.Put", id)
+	defer func() { endSpan(span, err, n) }()
+	C.maybeTrim()
+	return C.retryNoSpace(func() (OutputID, int64, error) {
+		mu := C.shard(id)
+		mu.Lock()
+		defer mu.Unlock()
+		if err := ctx.Err(); err != nil {
+			return OutputID{}, 0, err
+		}
+		out, n, err := C.put(id, ctxReadSeeker{ctx: ctx, ReadSeeker: file})
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return out, n, err
+		}
+		return out, n, C.setExpiry(id, time.Time{})
+	})
 }
 
-// GetBytes looks up the action ID in the cache and returns
-// the corresponding output bytes.
-// GetBytes should only be used for data that can be expected to fit in memory.
-func (C *Cache) GetBytes(id ActionID) ([]byte, cache.Entry, error) {
-	C.mu.Lock()
-	defer C.mu.Unlock()
-	return C.c.GetBytes(id)
+// PutWithExpiry is like Put, but the entry is treated as absent after expireAt,
+// regardless of the trim limits.
+//
+// The expiry is stored in a sidecar file (xxxx-e) next to the action entry.
+// A zero expireAt means no expiry, just as with Put.
+func (C *Cache) PutWithExpiry(id ActionID, file io.ReadSeeker, expireAt time.Time) (out OutputID, n int64, err error) {
+	_, span := C.startSpan(context.Background(), "filecache.PutWithExpiry", id)
+	defer func() { endSpan(span, err, n) }()
+	C.maybeTrim()
+	return C.retryNoSpace(func() (OutputID, int64, error) {
+		mu := C.shard(id)
+		mu.Lock()
+		defer mu.Unlock()
+		out, n, err := C.put(id, file)
+		if err != nil {
+			return out, n, err
+		}
+		return out, n, C.setExpiry(id, expireAt)
+	})
 }
 
-// GetFile looks up the action ID in the cache and returns
-// the name of the corresponding data file.
-func (C *Cache) GetFile(id ActionID) (file string, entry cache.Entry, err error) {
-	C.mu.Lock()
-	defer C.mu.Unlock()
-	return C.c.GetFile(id)
+// setExpiry writes the expiry sidecar of the action ID,
+// or removes it when expireAt is zero.
+//
+// As it is called after each put, which rewrites the action entry without the sidecars flag,
+// it flags the entry again if it has a Meta (see markSidecars).
+func (C *Cache) setExpiry(id ActionID, expireAt time.Time) error {
+	fn := C.fileName(id, "e")
+	if expireAt.IsZero() {
+		if err := os.Remove(fn); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if _, err := os.Stat(C.fileName(id, "m")); err == nil {
+			return C.markSidecars(id)
+		}
+		return nil
+	}
+	if err := renameio.WriteFile(fn, []byte(strconv.FormatInt(expireAt.UnixNano(), 10)), 0666); err != nil {
+		return err
+	}
+	return C.markSidecars(id)
 }
 
-// Trim removes old cache entries that are likely not to be reused.
-func (C *Cache) Trim() error {
-	C.mu.Lock()
-	defer C.mu.Unlock()
-	return C.trim()
+// isExpired reports whether the action ID has an expiry sidecar with a passed time.
+func (C *Cache) isExpired(id ActionID) bool {
+	expireAt, err := C.expiry(id)
+	return err == nil && !expireAt.IsZero() && !C.now().Before(expireAt)
 }
 
-func (C *Cache) trim() error {
-	now := C.now()
-	if !C.lastTrim.IsZero() && now.Sub(C.lastTrim) < C.trimInterval {
-		C.logger.Debug("skip trim", slog.Time("lastTrim", C.lastTrim), slog.String("trimInterval", C.trimInterval.String()))
+// expiry returns the expiry of the action ID, zero if it has none.
+func (C *Cache) expiry(id ActionID) (time.Time, error) {
+	b, err := os.ReadFile(C.fileName(id, "e"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return parseExpiry(b)
+}
+
+// parseExpiry parses the content of an expiry sidecar (xxxx-e).
+func parseExpiry(b []byte) (time.Time, error) {
+	t, err := strconv.ParseInt(string(bytes.TrimSpace(b)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, t), nil
+}
+
+// checkExpiry deletes the entry of the action ID and returns an error wrapping ErrNotFound,
+// if it is expired.
+func (C *Cache) checkExpiry(id ActionID) error {
+	if !C.isExpired(id) {
 		return nil
 	}
+	if err := C.delete(id); err != nil {
+		C.logger.Warn("delete expired", "actionID", fmt.Sprintf("%x", id), "error", err)
+	}
+	return fmt.Errorf("%w: %x expired", ErrNotFound, id)
+}
 
-	trimFn := filepath.Join(C.dir, "trim.txt")
-	// We maintain in dir/trim.txt the time of the last completed cache trim.
-	// If the cache has been trimmed recently enough, do nothing.
-	// This is the common case.
-	// If the trim file is corrupt, detected if the file can't be parsed, or the
-	// trim time is too far in the future, attempt the trim anyway. It's possible that
-	// the cache was full when the corruption happened. Attempting a trim on
-	// an empty cache is cheap, so there wouldn't be a big performance hit in that case.
-	if C.trimInterval > 0 {
-		if data, err := lockedfile.Read(trimFn); err == nil {
-			if t, err := strconv.ParseInt(string(bytes.TrimSpace(data)), 10, 64); err == nil {
-				C.lastTrim = time.Unix(t, 0)
-				if now.Sub(C.lastTrim) < C.trimInterval {
-					C.logger.Debug("skip trim", slog.Time("lastTrim", C.lastTrim), slog.String("trimInterval", C.trimInterval.String()))
-					return nil
-				}
-			}
+// PutBytes stores the given bytes in the cache as the output for the action ID.
+// As the data is in memory, it is safe to read it twice.
+func (C *Cache) PutBytes(id ActionID, data []byte) (out OutputID, err error) {
+	_, span := C.startSpan(context.Background(), "filecache.PutBytes", id)
+	defer func() { endSpan(span, err, int64(len(data))) }()
+	C.maybeTrim()
+	out, _, err = C.retryNoSpace(func() (OutputID, int64, error) {
+		mu := C.shard(id)
+		mu.Lock()
+		defer mu.Unlock()
+		out, n, err := C.put(id, bytes.NewReader(data))
+		if err != nil {
+			return out, n, err
+		}
+		return out, n, C.setExpiry(id, time.Time{})
+	})
+	return out, err
+}
+
+// PutFile stores the content of the named file in the cache as the output for the action ID.
+//
+// It reads the file only once (to compute its hash), then hardlinks it into the cache.
+// If that is not possible (for example the file is on another file system),
+// it falls back to copying the file.
+//
+// As the file may share its content with the cache afterwards,
+// it must not be modified - but it can be removed.
+func (C *Cache) PutFile(id ActionID, path string) (out OutputID, n int64, err error) {
+	_, span := C.startSpan(context.Background(), "filecache.PutFile", id)
+	defer func() { endSpan(span, err, n) }()
+	C.maybeTrim()
+	return C.retryNoSpace(func() (OutputID, int64, error) { return C.putFile(id, path) })
+}
+
+func (C *Cache) putFile(id ActionID, path string) (OutputID, int64, error) {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	fh, err := os.Open(path)
+	if err != nil {
+		return OutputID{}, 0, err
+	}
+	defer fh.Close()
+	if C.encoding() != nil {
+		// The file has to be encoded, it cannot be linked.
+		out, size, err := C.putEncoded(id, fh)
+		if err != nil {
+			return out, size, err
+		}
+		return out, size, C.setExpiry(id, time.Time{})
+	}
+	h := NewHash()
+	size, err := C.copy(h, fh)
+	if err != nil {
+		return OutputID{}, 0, err
+	}
+	out := OutputID(h.SumID())
+	if err := C.linkFile(path, out); err != nil {
+		C.logger.Debug("link", "file", path, "error", err)
+		if out, size, err = C.putPlain(id, fh); err != nil {
+			return out, size, err
 		}
+	} else if err = C.putIndexEntry(id, out, size); err != nil {
+		return out, size, err
 	}
+	C.stored(id)
+	return out, size, C.setExpiry(id, time.Time{})
+}
 
-	// Trim each of the 256 subdirectories.
-	cutoffTime := now.Add(-C.trimLimit)
-	cutoffSize := C.trimSize
-	sizeCutoffTime := now.Add(-C.trimInterval)
-	var size int64
-	for i := 0; i < 256; i++ {
-		subdir := filepath.Join(C.dir, fmt.Sprintf("%02x", i))
-		size += C.trimSubdir(subdir, cutoffTime, cutoffSize, sizeCutoffTime)
+// PutReader stores the content read from r in the cache as the output for the action ID.
+//
+// Unlike Put, it does not need to seek: the content is written into a temporary file
+// (in the TempDir) while hashing it, then renamed into place.
+// Only if compression or encryption is set, the temporary file is read again for encoding.
+//
+// As r cannot be read again, a disk full while writing the temporary file
+// is not retried: the cache is trimmed, and the error wraps ErrNoSpace.
+func (C *Cache) PutReader(id ActionID, r io.Reader) (OutputID, int64, error) {
+	return C.putReaderContext(context.Background(), id, r)
+}
+
+// putReaderContext is PutReader, with the context of the span.
+func (C *Cache) putReaderContext(ctx context.Context, id ActionID, r io.Reader) (out OutputID, n int64, err error) {
+	ctx, span := C.startSpan(ctx, "filecache.PutReader", id)
+	defer func() { endSpan(span, err, n) }()
+	fh, err := os.CreateTemp(C.tempDir, ".put-*")
+	if err != nil {
+		return OutputID{}, 0, C.noSpace(err)
 	}
-	C.logger.Warn("trim", "size", size, "maxSize", C.maxSize)
-	if C.maxSize > 0 && size > C.maxSize {
-		C.logger.Warn("truncate cache", "maxSize", C.maxSize, "size", size)
-		for i := 0; i < 256; i++ {
-			subdir := filepath.Join(C.dir, fmt.Sprintf("%02x", i))
-			dis, _ := os.ReadDir(subdir)
-			for _, di := range dis {
-				// Remove only cache entries (xxxx-a and xxxx-d).
-				if fi, err := di.Info(); err == nil {
-					size -= fi.Size()
-					if size <= C.maxSize/2 {
-						break
-					}
-				}
-				if name := di.Name(); len(name) > 2 {
-					switch name[len(name)-2:] {
-					case "-a", "-d":
-						os.Remove(filepath.Join(subdir, di.Name()))
-					}
-				}
-			}
+	defer func() {
+		_ = fh.Close()
+		_ = os.Remove(fh.Name())
+	}()
+	hr := NewHashReader(ctxReader{ctx: ctx, Reader: r})
+	size, err := C.copy(fh, hr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return OutputID{}, size, ctx.Err()
 		}
+		return OutputID{}, size, C.noSpace(err)
+	}
+	if C.encoding() != nil {
+		if _, err = fh.Seek(0, io.SeekStart); err != nil {
+			return OutputID{}, size, err
+		}
+		return C.PutContext(ctx, id, fh)
+	}
+	if err = fh.Chmod(0644); err != nil {
+		return OutputID{}, size, err
 	}
-	C.lastTrim = now
 
-	// Ignore errors from here: if we don't write the complete timestamp, the
-	// cache will appear older than it is, and we'll trim it again next time.
-	var b bytes.Buffer
-	fmt.Fprintf(&b, "%d", now.Unix())
-	if err := lockedfile.Write(trimFn, &b, 0666); err != nil {
-		C.logger.Error("write", slog.String("file", trimFn), slog.Any("error", err))
-		return err
+	C.maybeTrim()
+	out = OutputID(hr.SumID())
+	return C.retryNoSpace(func() (OutputID, int64, error) { return C.putTemp(id, fh, out, size) })
+}
+
+// putTemp renames the temporary file fh, with the content of output ID out,
+// into the data file, and adds the index entry for the action ID.
+func (C *Cache) putTemp(id ActionID, fh *os.File, out OutputID, size int64) (OutputID, int64, error) {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	name := C.fileName(out, "d")
+	var err error
+	if err = os.Rename(fh.Name(), name); err != nil {
+		C.logger.Debug("rename", "file", fh.Name(), "error", err)
+		if _, err = fh.Seek(0, io.SeekStart); err != nil {
+			return out, size, err
+		}
+		if out, size, err = C.putPlain(id, fh); err != nil {
+			return out, size, err
+		}
+	} else {
+		now := C.now()
+		_ = os.Chtimes(name, now, now)
+		if err = C.putIndexEntry(id, out, size); err != nil {
+			return out, size, err
+		}
 	}
+	C.stored(id)
+	return out, size, C.setExpiry(id, time.Time{})
+}
 
-	return nil
+// put stores file as the output of the action ID, encoded iff compression or encryption is set.
+func (C *Cache) put(id ActionID, file io.ReadSeeker) (OutputID, int64, error) {
+	var out OutputID
+	var n int64
+	var err error
+	if C.encoding() == nil {
+		out, n, err = C.putPlain(id, file)
+	} else {
+		out, n, err = C.putEncoded(id, file)
+	}
+	if err == nil {
+		C.stored(id)
+	}
+	return out, n, err
 }
 
-// trimSubdir trims a single cache subdirectory.
-func (C *Cache) trimSubdir(subdir string, cutoffTime time.Time, cutoffSize int64, sizeCutoffTime time.Time) int64 {
-	// Read all directory entries from subdir before removing
-	// any files, in case removing files invalidates the file offset
-	// in the directory scan. Also, ignore error from f.Readdirnames,
-	// because we don't care about reporting the error and we still
-	// want to process any entries found before the error.
-	f, err := os.Open(subdir)
+// putPlain stores the file as the output of the action ID, without encoding.
+//
+// If the copy fails (the disk is full, or the context is cancelled), the data file
+// the underlying cache has started to write (and truncated) is removed,
+// so no partial data file is left behind.
+func (C *Cache) putPlain(id ActionID, file io.ReadSeeker) (OutputID, int64, error) {
+	out, size, err := C.c.Put(id, file)
+	if err != nil && out != (OutputID{}) {
+		name := C.fileName(out, "d")
+		if fi, statErr := os.Stat(name); statErr == nil && fi.Size() != size {
+			_ = os.Remove(name)
+		}
+	}
+	return out, size, err
+}
+
+// putEncoded stores the encoded file as the output of the action ID.
+// The OutputID and the size recorded in the action entry are those of the plain content.
+func (C *Cache) putEncoded(id ActionID, file io.ReadSeeker) (OutputID, int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return OutputID{}, 0, err
+	}
+	h := NewHash()
+	size, err := C.copy(h, file)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			C.logger.Warn("Open", "subdir", subdir)
+		return OutputID{}, 0, err
+	}
+	out := OutputID(h.SumID())
+	if err := C.writeEncoded(file, out, size); err != nil {
+		return out, size, err
+	}
+	return out, size, C.putIndexEntry(id, out, size)
+}
+
+// writeEncoded encodes file into the data file of out (if not already present),
+// expecting it to have the given output ID and size.
+// If it is not encrypted and compression does not make it smaller, the data is stored plain.
+func (C *Cache) writeEncoded(file io.ReadSeeker, out OutputID, size int64) error {
+	name := C.fileName(out, "d")
+	if rc, hdr, err := C.openData(name, size); err == nil && hdr.encrypted == (C.cipher != nil) {
+		h := NewHash()
+		_, err = C.copy(h, rc)
+		rc.Close()
+		if err == nil && OutputID(h.SumID()) == out {
+			now := C.now()
+			_ = os.Chtimes(name, now, now)
+			return nil
 		}
-		return 0
+		// Hash did not match. Fall through and rewrite file.
 	}
-	defer f.Close()
-	var size int64
-	for {
-		dis, _ := f.ReadDir(128)
-		if len(dis) == 0 {
-			break
+
+	pf, err := renameio.NewPendingFile(name, renameio.WithPermissions(0666))
+	if err != nil {
+		return err
+	}
+	defer pf.Cleanup()
+	copyTo := func(w io.Writer) error {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		h := NewHash()
+		if _, err := C.copy(w, io.TeeReader(file, h)); err != nil {
+			return err
+		}
+		if OutputID(h.SumID()) != out {
+			return errors.New("file content changed underfoot")
+		}
+		return nil
+	}
+	codec := C.encoding()
+	if _, err = writeDataHeader(pf, codec, size); err != nil {
+		return err
+	}
+	cw, err := codec.NewWriter(pf)
+	if err != nil {
+		return err
+	}
+	if err = copyTo(cw); err != nil {
+		return err
+	}
+	if err = cw.Close(); err != nil {
+		return err
+	}
+	if fi, err := pf.Stat(); err != nil {
+		return err
+	} else if fi.Size() >= size && C.cipher == nil {
+		if err = pf.Truncate(0); err != nil {
+			return err
+		}
+		if _, err = pf.Seek(0, io.SeekStart); err != nil {
+			return err
 		}
+		if err = copyTo(pf); err != nil {
+			return err
+		}
+	}
+	if err = pf.CloseAtomicallyReplace(); err != nil {
+		return err
+	}
+	now := C.now()
+	_ = os.Chtimes(name, now, now)
+	return nil
+}
 
-		for _, di := range dis {
-			// C.logger.Info("list", "entry", di.Name())
-			name := di.Name()
-			// Remove only cache entries (xxxx-a and xxxx-d).
-			if !strings.HasSuffix(name, "-a") && !strings.HasSuffix(name, "-d") {
-				continue
-			}
-			entry := filepath.Join(subdir, name)
-			info, err := os.Stat(entry)
-			if err != nil {
-				C.logger.Warn("stat", "entry", entry, "error", err)
-				continue
-			}
-			if info.ModTime().Before(cutoffTime) ||
-				(cutoffSize > 0 && info.Size() > cutoffSize && info.ModTime().Before(sizeCutoffTime)) {
-				// C.logger.Info("remove", "entry", entry)
-				os.Remove(entry)
-			} else {
-				// C.logger.Info("keep", "entry", entry, "size", size, "info", info.Size())
-				size += info.Size()
+// lookup looks up the action ID (see entry) and returns the name of its data file,
+// and its header.
+func (C *Cache) lookup(id ActionID) (file string, entry cache.Entry, hdr dataHeader, sidecars bool, err error) {
+	if entry, sidecars, err = C.entry(id); err != nil {
+		return "", cache.Entry{}, hdr, false, err
+	}
+	file = C.c.OutputFile(entry.OutputID)
+	fh, err := os.Open(file)
+	if err != nil {
+		return "", cache.Entry{}, hdr, false, fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	hdr, err = C.dataHeader(fh, entry.Size)
+	fh.Close()
+	if err != nil {
+		if !errors.Is(err, ErrAuthentication) {
+			err = fmt.Errorf("%w: %w", ErrNotFound, err)
+		}
+		return "", cache.Entry{}, hdr, false, err
+	}
+	return file, entry, hdr, sidecars, nil
+}
+
+// plainFile returns the name of the uncompressed copy of the encoded data file,
+// creating it under dir/plain if needed.
+//
+// Encrypted data files are not copied in plain.
+func (C *Cache) plainFile(file string, entry cache.Entry, hdr dataHeader) (string, error) {
+	if hdr.encrypted {
+		return "", fmt.Errorf("GetFile of an encrypted entry (use GetReader): %w", errors.ErrUnsupported)
+	}
+	dir := filepath.Join(C.dir, "plain")
+	name := filepath.Join(dir, filepath.Base(file))
+	now := C.now()
+	if fi, err := os.Stat(name); err == nil && fi.Size() == entry.Size {
+		_ = os.Chtimes(name, now, now)
+		return name, nil
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	rc, _, err := C.openData(file, entry.Size)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	defer rc.Close()
+	pf, err := renameio.NewPendingFile(name, renameio.WithPermissions(0666))
+	if err != nil {
+		return "", err
+	}
+	defer pf.Cleanup()
+	h := NewHash()
+	if _, err = C.copy(io.MultiWriter(pf, h), rc); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	if OutputID(h.SumID()) != entry.OutputID {
+		return "", fmt.Errorf("%w: bad checksum", ErrNotFound)
+	}
+	if err = pf.CloseAtomicallyReplace(); err != nil {
+		return "", err
+	}
+	_ = os.Chtimes(name, now, now)
+	return name, nil
+}
+
+// linkFile hardlinks path into the cache as the data file of out.
+func (C *Cache) linkFile(path string, out OutputID) error {
+	name := C.fileName(out, "d")
+	tmp := fmt.Sprintf("%s.%d-%d.tmp", name, os.Getpid(), time.Now().UnixNano())
+	if err := os.Link(path, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	now := C.now()
+	_ = os.Chtimes(name, now, now)
+	return nil
+}
+
+// putIndexEntry adds an entry to the cache recording that executing the action
+// with the given id produces an output with the given output id (hash) and size,
+// in the same format as the underlying cache.
+func (C *Cache) putIndexEntry(id ActionID, out OutputID, size int64) error {
+	entry := formatIndexEntry(id, out, size, time.Now().UnixNano())
+	file := C.fileName(id, "a")
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(entry)
+	if err == nil {
+		// Truncate only after writing, so a second write of the same content is idempotent.
+		err = f.Truncate(int64(len(entry)))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file)
+		return err
+	}
+	now := C.now()
+	_ = os.Chtimes(file, now, now)
+	return nil
+}
+
+// Get looks up the action ID in the cache,
+// returning the corresponding output ID and file size, if any.
+// Note that finding an output ID does not guarantee that the
+// saved file for that output ID is still available.
+func (C *Cache) Get(id ActionID) (cache.Entry, error) {
+	_, span := C.startSpan(context.Background(), "filecache.Get", id)
+	entry, err := C.get(id)
+	C.countGet(err, 0)
+	endGetSpan(span, err, 0)
+	return entry, err
+}
+
+func (C *Cache) get(id ActionID) (cache.Entry, error) {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	entry, _, err := C.entry(id)
+	return entry, err
+}
+
+// Has reports whether the action ID is in the cache,
+// without opening or reading the data file.
+// A missing or corrupt entry is reported as (false, nil),
+// only real I/O errors are returned.
+func (C *Cache) Has(id ActionID) (bool, error) {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, _, err := C.entry(id); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// GetBytes looks up the action ID in the cache and returns
+// the corresponding output bytes.
+// GetBytes should only be used for data that can be expected to fit in memory.
+func (C *Cache) GetBytes(id ActionID) ([]byte, cache.Entry, error) {
+	ctx, span := C.startSpan(context.Background(), "filecache.GetBytes", id)
+	data, entry, err := C.getBytes(id)
+	if C.fromSource(ctx, id, err) {
+		data, entry, err = C.getBytes(id)
+	}
+	C.countGet(err, int64(len(data)))
+	endGetSpan(span, err, int64(len(data)))
+	return data, entry, err
+}
+
+func (C *Cache) getBytes(id ActionID) ([]byte, cache.Entry, error) {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	file, entry, _, _, err := C.lookup(id)
+	if err != nil {
+		return nil, entry, err
+	}
+	rc, _, err := C.openData(file, entry.Size)
+	if err != nil {
+		return nil, entry, fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, entry, fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	if C.verifyOnGet {
+		if err := C.verify(id, bytes.NewReader(data), entry); err != nil {
+			return nil, entry, err
+		}
+	} else if OutputID(SumID(data)) != entry.OutputID {
+		return nil, entry, fmt.Errorf("%w: bad checksum", ErrNotFound)
+	}
+	return data, entry, nil
+}
+
+// GetFile looks up the action ID in the cache and returns
+// the name of the corresponding data file.
+//
+// For compressed entries, this is an uncompressed copy, kept till the next trim.
+// For encrypted entries, this returns an error wrapping errors.ErrUnsupported, use GetReader.
+func (C *Cache) GetFile(id ActionID) (file string, entry cache.Entry, err error) {
+	return C.GetFileContext(context.Background(), id)
+}
+
+// GetFileContext is like GetFile, but returns ctx.Err() when ctx is cancelled.
+func (C *Cache) GetFileContext(ctx context.Context, id ActionID) (file string, entry cache.Entry, err error) {
+	ctx, span := C.startSpan(ctx, "filecache.GetFile", id)
+	file, entry, err = C.getFile(ctx, id)
+	if C.fromSource(ctx, id, err) {
+		file, entry, err = C.getFile(ctx, id)
+	} else if err != nil && ctx.Err() != nil {
+		// The fetch from the source has been aborted.
+		err = ctx.Err()
+	}
+	C.countGet(err, entry.Size)
+	endGetSpan(span, err, entry.Size)
+	return file, entry, err
+}
+
+func (C *Cache) getFile(ctx context.Context, id ActionID) (string, cache.Entry, error) {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return "", cache.Entry{}, err
+	}
+	file, entry, hdr, _, err := C.lookup(id)
+	if err != nil {
+		return "", cache.Entry{}, err
+	}
+	if hdr.codec != nil {
+		if file, err = C.plainFile(file, entry, hdr); err != nil {
+			return "", cache.Entry{}, err
+		}
+	}
+	if C.verifyOnGet {
+		if err = C.verifyFile(id, file, entry); err != nil {
+			return "", cache.Entry{}, err
+		}
+	}
+	if C.touchOnGet {
+		if err = C.touch(id, entry.OutputID); err != nil {
+			C.logger.Debug("touch", "id", fmt.Sprintf("%x", id), "error", err)
+		}
+	}
+	return file, entry, nil
+}
+
+// Touch sets the modification time of the action entry and its data file to now,
+// so they are considered new by trim.
+// An expired entry is not found.
+func (C *Cache) Touch(id ActionID) error {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	entry, _, err := C.entry(id)
+	if err != nil {
+		return err
+	}
+	return C.touch(id, entry.OutputID)
+}
+
+func (C *Cache) touch(id ActionID, out OutputID) error {
+	now := C.now()
+	if err := os.Chtimes(C.fileName(id, "a"), now, now); err != nil {
+		return err
+	}
+	if err := os.Chtimes(C.c.OutputFile(out), now, now); err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("%w: %w", ErrNotFound, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// verifyFile checks that the content of the data file matches entry, deleting the action ID on mismatch.
+func (C *Cache) verifyFile(id ActionID, file string, entry cache.Entry) error {
+	rc, _, err := C.openData(file, entry.Size)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	defer rc.Close()
+	return C.verify(id, rc, entry)
+}
+
+// verify checks that the content of r matches entry, deleting the action ID on mismatch.
+func (C *Cache) verify(id ActionID, r io.Reader, entry cache.Entry) error {
+	h := NewHash()
+	if _, err := C.copy(h, r); err != nil {
+		return err
+	}
+	if OutputID(h.SumID()) == entry.OutputID {
+		return nil
+	}
+	C.logger.Warn("corrupt entry", "actionID", fmt.Sprintf("%x", id), "outputID", fmt.Sprintf("%x", entry.OutputID))
+	if err := C.delete(id); err != nil {
+		C.logger.Error("delete corrupt entry", "error", err)
+	}
+	return fmt.Errorf("%w: %x", ErrCorrupt, id)
+}
+
+// Delete removes the action ID and its data file from the cache.
+// Deleting an absent entry is not an error.
+//
+// Note that the data file may be shared by other action IDs with the same output,
+// those will become misses, too.
+func (C *Cache) Delete(id ActionID) error {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	return C.delete(id)
+}
+
+// DeleteEntry is like Delete, but keeps the data file, for the other action IDs sharing it.
+// A data file left without action entries is removed by trim.
+func (C *Cache) DeleteEntry(id ActionID) error {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	return C.deleteEntry(id)
+}
+
+func (C *Cache) delete(id ActionID) error {
+	entry, getErr := C.c.Get(id)
+	if err := C.deleteEntry(id); err != nil {
+		return err
+	}
+	if getErr != nil {
+		return nil
+	}
+	if err := os.Remove(C.fileName(entry.OutputID, "d")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// deleteEntry removes the action entry of id, with its sidecars.
+func (C *Cache) deleteEntry(id ActionID) error {
+	for _, key := range []string{"a", "e", "m"} {
+		if err := os.Remove(C.fileName(id, key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy copies from src to dst like io.Copy, but with a pooled buffer.
+func (C *Cache) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if _, ok := dst.(*os.File); ok {
+		if _, ok := src.(*os.File); ok {
+			// The kernel may copy it (copy_file_range), without any buffer.
+			return io.Copy(dst, src)
+		}
+	}
+	bp := C.bufs.Get().(*[]byte)
+	defer C.bufs.Put(bp)
+	// Hide ReadFrom and WriteTo (of *os.File, for example), as their fallbacks allocate their own buffer.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *bp)
+}
+
+// ctxReadSeeker is an io.ReadSeeker which returns ctx.Err() after ctx is cancelled.
+type ctxReadSeeker struct {
+	ctx context.Context
+	io.ReadSeeker
+}
+
+func (r ctxReadSeeker) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadSeeker.Read(p)
+}
+
+// ctxReader is an io.Reader which returns ctx.Err() after ctx is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// isNotFound reports whether the error returned by the underlying cache
+// means a missing (or unusable) entry, and not an I/O error.
+func isNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrNotFound) {
+		return true
+	}
+	var pe *fs.PathError
+	return !errors.As(err, &pe) || errors.Is(err, fs.ErrNotExist)
+}
+
+// fileName returns the name of the file corresponding to the given id,
+// using the same layout as the underlying cache.
+func (C *Cache) fileName(id [cache.HashSize]byte, key string) string {
+	return filepath.Join(C.dir, fmt.Sprintf("%02x", id[0]), fmt.Sprintf("%x", id)+"-"+key)
+}
+
+// Dir returns the root directory of the cache.
+func (C *Cache) Dir() string { return C.dir }
+
+// TempDir returns the directory of the temporary files of the cache, see WithTempDir.
+func (C *Cache) TempDir() string { return C.tempDir }
+
+// FileName returns the name of the data file (xx/<output ID>-d) of id,
+// as recorded in its action entry, without opening it - e.g. for hardlinking.
+// It returns the empty string if there is no (unexpired) entry for id.
+//
+// With compression or encryption, the data file may be encoded:
+// use GetFile for its plain content.
+func (C *Cache) FileName(id ActionID) string {
+	entry, _, err := C.entry(id)
+	if err != nil {
+		return ""
+	}
+	return C.OutputFile(entry.OutputID)
+}
+
+// ActionFile returns the name of the action entry file (xx/<action ID>-a) of id,
+// whether it exists or not.
+func (C *Cache) ActionFile(id ActionID) string { return C.fileName(id, "a") }
+
+// OutputFile returns the name of the data file (xx/<output ID>-d) of out,
+// whether it exists or not.
+//
+// With compression or encryption, the data file may be encoded:
+// use GetFile for its plain content.
+func (C *Cache) OutputFile(out OutputID) string { return C.fileName(out, "d") }
+
+// CacheStats is a snapshot of the cache's data files.
+type CacheStats struct {
+	// Oldest is the modification time of the oldest data file.
+	Oldest time.Time
+	// Newest is the modification time of the newest data file.
+	Newest time.Time
+	// Count is the number of data files.
+	Count int
+	// PhysicalSize is the total size of the data files on disk,
+	// what the trim limits (WithMaxSize, WithTrimSize) are about.
+	PhysicalSize int64
+	// LogicalSize is the total size of the content of the data files,
+	// as recorded in the action entries - with compression or encryption,
+	// this differs from PhysicalSize.
+	// The data files without action entries are counted with their physical size.
+	LogicalSize int64
+
+	// Size is PhysicalSize.
+	//
+	// Deprecated: use PhysicalSize (or LogicalSize).
+	Size int64
+}
+
+// Stats walks the cache and returns the number, total (physical and logical) size
+// and the oldest and newest modification time of the data files.
+func (C *Cache) Stats() (CacheStats, error) {
+	C.trimMu.Lock()
+	defer C.trimMu.Unlock()
+	var st CacheStats
+	// The action entries of a data file may be in any subdirectory,
+	// so the logical sizes are collected first, and summed up at the end.
+	logical := make(map[OutputID]int64)
+	physical := make(map[OutputID]int64)
+	for i := 0; i < 256; i++ {
+		subdir := filepath.Join(C.dir, fmt.Sprintf("%02x", i))
+		dis, err := os.ReadDir(subdir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return st, err
+		}
+		for _, di := range dis {
+			name := di.Name()
+			if strings.HasSuffix(name, "-a") {
+				if b, err := os.ReadFile(filepath.Join(subdir, name)); err == nil {
+					if _, entry, err := parseIndexEntry(b); err == nil {
+						logical[entry.OutputID] = entry.Size
+					}
+				}
+				continue
+			}
+			if !strings.HasSuffix(name, "-d") {
+				continue
+			}
+			var out OutputID
+			b, err := hex.DecodeString(strings.TrimSuffix(name, "-d"))
+			if err != nil || len(b) != len(out) {
+				continue
+			}
+			copy(out[:], b)
+			fi, err := di.Info()
+			if err != nil {
+				continue
+			}
+			st.Count++
+			st.PhysicalSize += fi.Size()
+			physical[out] = fi.Size()
+			t := fi.ModTime()
+			if st.Oldest.IsZero() || t.Before(st.Oldest) {
+				st.Oldest = t
+			}
+			if t.After(st.Newest) {
+				st.Newest = t
+			}
+		}
+	}
+	for out, size := range physical {
+		if n, ok := logical[out]; ok {
+			size = n
+		}
+		st.LogicalSize += size
+	}
+	st.Size = st.PhysicalSize
+	return st, nil
+}
+
+// Range calls fn for each action in the cache, until fn returns false.
+//
+// The iteration order is unspecified. Range does not hold any lock while
+// calling fn, so a concurrent trim (or Delete) may remove entries mid-iteration,
+// and entries added during the iteration may or may not be visited.
+// Unparsable and expired entries are skipped.
+func (C *Cache) Range(fn func(id ActionID, entry cache.Entry) bool) error {
+	for i := 0; i < 256; i++ {
+		subdir := filepath.Join(C.dir, fmt.Sprintf("%02x", i))
+		dis, err := os.ReadDir(subdir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, di := range dis {
+			if !strings.HasSuffix(di.Name(), "-a") {
+				continue
+			}
+			b, err := os.ReadFile(filepath.Join(subdir, di.Name()))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			id, entry, err := parseIndexEntry(b)
+			if err != nil {
+				C.logger.Debug("parse", "file", di.Name(), "error", err)
+				continue
+			}
+			if hasSidecars(b) && C.isExpired(id) {
+				continue
+			}
+			if !fn(id, entry) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// formatIndexEntry returns the action entry in the format of the underlying cache.
+func formatIndexEntry(id ActionID, out OutputID, size, unixNano int64) string {
+	return fmt.Sprintf("v1 %x %x %20d %20d\n", id, out, size, unixNano)
+}
+
+// parseIndexEntry parses an action entry (xxxx-a file) written
+// by formatIndexEntry.
+func parseIndexEntry(b []byte) (ActionID, cache.Entry, error) {
+	const hexSize = 2 * cache.HashSize
+	const entrySize = 2 + 1 + hexSize + 1 + hexSize + 1 + 20 + 1 + 20 + 1
+	var id ActionID
+	var entry cache.Entry
+	if len(b) != entrySize || b[entrySize-1] != '\n' {
+		return id, entry, fmt.Errorf("bad entry length %d", len(b))
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 5 || fields[0] != "v1" {
+		return id, entry, errors.New("invalid header")
+	}
+	if _, err := hex.Decode(id[:], []byte(fields[1])); err != nil {
+		return id, entry, fmt.Errorf("decoding ID: %w", err)
+	}
+	if _, err := hex.Decode(entry.OutputID[:], []byte(fields[2])); err != nil {
+		return id, entry, fmt.Errorf("decoding output ID: %w", err)
+	}
+	var err error
+	if entry.Size, err = strconv.ParseInt(fields[3], 10, 64); err != nil || entry.Size < 0 {
+		return id, entry, fmt.Errorf("parsing size %q: %w", fields[3], err)
+	}
+	tm, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil || tm < 0 {
+		return id, entry, fmt.Errorf("parsing timestamp %q: %w", fields[4], err)
+	}
+	entry.Time = time.Unix(0, tm)
+	return id, entry, nil
+}
+
+// sizeOffset is the offset of the (space padded) size in an action entry.
+const sizeOffset = 2 + 1 + 2*cache.HashSize + 1 + 2*cache.HashSize + 1
+
+// hasSidecars reports whether the action entry is flagged to have sidecars, see markSidecars.
+func hasSidecars(b []byte) bool {
+	return len(b) >= sizeOffset+20 && bytes.IndexByte(b[sizeOffset:sizeOffset+20], '+') >= 0
+}
+
+// markSidecars flags the action entry of the action ID to have sidecars (xxxx-e or xxxx-m),
+// as the Get methods look for them only in a flagged entry.
+//
+// The flag is a plus sign in the padding of the size, which the underlying cache
+// parses as the same number.
+func (C *Cache) markSidecars(id ActionID) error {
+	fn := C.fileName(id, "a")
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	if _, _, err = parseIndexEntry(b); err != nil || hasSidecars(b) {
+		return err
+	}
+	b[sizeOffset+bytes.LastIndexByte(b[sizeOffset:sizeOffset+20], ' ')] = '+'
+	if err = renameio.WriteFile(fn, b, 0666); err != nil {
+		return err
+	}
+	// Keep the modification time, trim goes by it.
+	return os.Chtimes(fn, fi.ModTime(), fi.ModTime())
+}
+
+// entry reads the action entry of the action ID, and reports whether it is flagged to have sidecars.
+// Only a flagged entry is checked for expiry (see checkExpiry),
+// so an entry without sidecars costs no more reads.
+func (C *Cache) entry(id ActionID) (cache.Entry, bool, error) {
+	b, err := os.ReadFile(C.fileName(id, "a"))
+	if err != nil {
+		// As the underlying cache does, treat any error as a miss.
+		return cache.Entry{}, false, fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	eid, entry, err := parseIndexEntry(b)
+	if err == nil && eid != id {
+		err = errors.New("mismatched ID")
+	}
+	if err != nil {
+		return cache.Entry{}, false, fmt.Errorf("%w: %x: %w", ErrNotFound, id, err)
+	}
+	sidecars := hasSidecars(b)
+	if sidecars {
+		if err = C.checkExpiry(id); err != nil {
+			return cache.Entry{}, false, err
+		}
+	}
+	return entry, sidecars, nil
+}
+
+// Clear removes all cache entries (xxxx-a, xxxx-d, xxxx-e and xxxx-m files),
+// leaving the directory structure in place.
+func (C *Cache) Clear() error {
+	C.trimMu.Lock()
+	defer C.trimMu.Unlock()
+	for i := range C.shards {
+		C.shards[i].Lock()
+		defer C.shards[i].Unlock()
+	}
+	var firstErr error
+	for i := 0; i < 256; i++ {
+		subdir := filepath.Join(C.dir, fmt.Sprintf("%02x", i))
+		dis, err := os.ReadDir(subdir)
+		if err != nil {
+			if !os.IsNotExist(err) && firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, di := range dis {
+			if name := di.Name(); strings.HasSuffix(name, "-a") || strings.HasSuffix(name, "-d") ||
+				strings.HasSuffix(name, "-e") || strings.HasSuffix(name, "-m") {
+				if err := os.Remove(filepath.Join(subdir, name)); err != nil && !os.IsNotExist(err) && firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(C.dir, "plain")); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	C.lastTrim = time.Time{}
+	C.subdirSize, C.subdirCount = [256]int64{}, [256]int64{}
+	if err := C.writeTrimFile(C.now()); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// GetReader looks up the action ID in the cache and returns
+// the opened corresponding data file (decompressed, if needed).
+//
+// A missing entry is reported with an error wrapping ErrNotFound.
+func (C *Cache) GetReader(id ActionID) (io.ReadCloser, cache.Entry, error) {
+	return C.getReaderContext(context.Background(), id)
+}
+
+// getReaderContext is GetReader, with the context of the span and the source.
+func (C *Cache) getReaderContext(ctx context.Context, id ActionID) (io.ReadCloser, cache.Entry, error) {
+	ctx, span := C.startSpan(ctx, "filecache.GetReader", id)
+	rc, entry, err := C.getReader(id)
+	if C.fromSource(ctx, id, err) {
+		rc, entry, err = C.getReader(id)
+	}
+	C.countGet(err, entry.Size)
+	endGetSpan(span, err, entry.Size)
+	return rc, entry, err
+}
+
+// GetEncodedReader is like GetReader, but if the data file is stored compressed
+// with one of the accepted codecs (and not encrypted), it returns the compressed
+// content as stored with that codec, so it can be passed on without recompressing.
+// Otherwise the plain content is returned with a nil Codec.
+func (C *Cache) GetEncodedReader(id ActionID, accept ...Codec) (io.ReadCloser, Codec, cache.Entry, error) {
+	rc, codec, entry, _, err := C.getEncodedReaderContext(context.Background(), id, accept)
+	return rc, codec, entry, err
+}
+
+// getEncodedReaderContext is GetEncodedReader, with the context of the span and the source.
+// It reports whether the entry has sidecars, too (see markSidecars).
+func (C *Cache) getEncodedReaderContext(ctx context.Context, id ActionID, accept []Codec) (rc io.ReadCloser, codec Codec, entry cache.Entry, sidecars bool, err error) {
+	ctx, span := C.startSpan(ctx, "filecache.GetEncodedReader", id)
+	rc, codec, entry, sidecars, err = C.getEncodedReader(id, accept)
+	if C.fromSource(ctx, id, err) {
+		rc, codec, entry, sidecars, err = C.getEncodedReader(id, accept)
+	}
+	C.countGet(err, entry.Size)
+	endGetSpan(span, err, entry.Size)
+	return rc, codec, entry, sidecars, err
+}
+
+func (C *Cache) getEncodedReader(id ActionID, accept []Codec) (io.ReadCloser, Codec, cache.Entry, bool, error) {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	file, entry, hdr, sidecars, err := C.lookup(id)
+	if err != nil {
+		return nil, nil, entry, false, err
+	}
+	if C.verifyOnGet {
+		if err = C.verifyFile(id, file, entry); err != nil {
+			return nil, nil, entry, false, err
+		}
+	}
+	if hdr.codec != nil && !hdr.encrypted && slices.ContainsFunc(accept, func(c Codec) bool { return c.Name() == hdr.codec.Name() }) {
+		fh, err := os.Open(file)
+		if err != nil {
+			return nil, nil, entry, false, fmt.Errorf("%w: %w", ErrNotFound, err)
+		}
+		// dataHeader leaves fh positioned after the header.
+		if hdr, err = C.dataHeader(fh, entry.Size); err != nil || hdr.codec == nil {
+			fh.Close()
+			return nil, nil, entry, false, fmt.Errorf("%w: %w", ErrNotFound, cmp.Or(err, errBadHeader))
+		}
+		return fh, hdr.codec, entry, sidecars, nil
+	}
+	rc, _, err := C.openData(file, entry.Size)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errBadHeader) {
+			err = fmt.Errorf("%w: %w", ErrNotFound, err)
+		}
+		return nil, nil, entry, false, err
+	}
+	return rc, nil, entry, sidecars, nil
+}
+
+func (C *Cache) getReader(id ActionID) (io.ReadCloser, cache.Entry, error) {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	file, entry, _, _, err := C.lookup(id)
+	if err != nil {
+		return nil, entry, err
+	}
+	if C.verifyOnGet {
+		if err = C.verifyFile(id, file, entry); err != nil {
+			return nil, entry, err
+		}
+	}
+	rc, _, err := C.openData(file, entry.Size)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errBadHeader) {
+			err = fmt.Errorf("%w: %w", ErrNotFound, err)
+		}
+		return nil, entry, err
+	}
+	return rc, entry, nil
+}
+
+// GetOrPut returns the cached output for the action ID,
+// calling compute and storing its result on a miss.
+//
+// Concurrent calls with the same action ID are deduplicated:
+// only one compute runs, the others wait for it and read the stored result.
+// If the returned io.ReadSeeker is an io.Closer, it is closed after the Put.
+func (C *Cache) GetOrPut(id ActionID, compute func() (io.ReadSeeker, error)) (io.ReadCloser, error) {
+	if rc, _, err := C.GetReader(id); err == nil {
+		return rc, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if _, err, _ := C.group.Do(hex.EncodeToString(id[:]), func() (any, error) {
+		// Another call may have stored it since our miss.
+		if ok, err := C.Has(id); err == nil && ok {
+			return nil, nil
+		}
+		r, err := compute()
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+		}
+		_, _, err = C.Put(id, r)
+		return nil, err
+	}); err != nil {
+		return nil, err
+	}
+	rc, _, err := C.GetReader(id)
+	return rc, err
+}
+
+// fromSource stores the entry of the action ID from the BlobStore or the source
+// (see WithBlobStore and WithSource), iff err is a miss.
+// It reports whether the entry has been stored, so the lookup can be retried.
+func (C *Cache) fromSource(ctx context.Context, id ActionID, err error) bool {
+	if (C.source == nil && C.blobs == nil) || !errors.Is(err, ErrNotFound) {
+		return false
+	}
+	if _, err = C.storeFrom(ctx, id, C.fetch); err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			C.logger.Warn("source", "actionID", fmt.Sprintf("%x", id), "error", err)
+		}
+		return false
+	}
+	return true
+}
+
+// storeFrom stores the content returned by fetch as the output of the action ID,
+// unless it is stored already. It reports whether it has been fetched.
+func (C *Cache) storeFrom(ctx context.Context, id ActionID, fetch Fetcher) (bool, error) {
+	// Share the key with GetOrPut, so a compute and a fetch do not run concurrently.
+	fetched, err, _ := C.group.Do(hex.EncodeToString(id[:]), func() (any, error) {
+		// Another call may have stored it since our miss.
+		if ok, err := C.Has(id); err == nil && ok {
+			return false, nil
+		}
+		rc, err := fetch(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		defer rc.Close()
+		_, _, err = C.putReaderContext(ctx, id, rc)
+		return err == nil, err
+	})
+	ok, _ := fetched.(bool)
+	return ok, err
+}
+
+// Metrics is a snapshot of the cache's counters since Open.
+type Metrics struct {
+	// Hits and Misses count the lookups of the Get* methods.
+	Hits, Misses int64
+	// Puts counts the successful stores.
+	Puts int64
+	// Evictions counts the data files removed by trim.
+	Evictions int64
+	// BytesServed is the total size of the entries returned by the Get* methods.
+	BytesServed int64
+	// TrimDuration is the total time spent trimming.
+	TrimDuration time.Duration
+	// Size and Count are the total size of the cache files (xxxx-a and xxxx-d)
+	// and the number of the data files, as left by the last trim - zero before the first one.
+	// Unlike Stats, they do not need a walk of the cache.
+	Size, Count int64
+}
+
+type metrics struct {
+	hits, misses, puts, evictions, bytesServed, trimDuration atomic.Int64
+	size, count                                              atomic.Int64
+}
+
+// Metrics returns the current values of the cache's counters.
+func (C *Cache) Metrics() Metrics {
+	return Metrics{
+		Hits:         C.metrics.hits.Load(),
+		Misses:       C.metrics.misses.Load(),
+		Puts:         C.metrics.puts.Load(),
+		Evictions:    C.metrics.evictions.Load(),
+		BytesServed:  C.metrics.bytesServed.Load(),
+		TrimDuration: time.Duration(C.metrics.trimDuration.Load()),
+		Size:         C.metrics.size.Load(),
+		Count:        C.metrics.count.Load(),
+	}
+}
+
+// countGet counts the result of a lookup as a hit (serving size bytes) or a miss.
+func (C *Cache) countGet(err error, size int64) {
+	switch {
+	case err == nil:
+		C.metrics.hits.Add(1)
+		C.metrics.bytesServed.Add(size)
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+	case isNotFound(err) || errors.Is(err, ErrCorrupt):
+		C.metrics.misses.Add(1)
+	}
+}
+
+// Trim removes old cache entries that are likely not to be reused.
+func (C *Cache) Trim() error {
+	_, err := C.TrimResult()
+	return err
+}
+
+// TrimResult is the outcome of a trim.
+type TrimResult struct {
+	// ScannedFiles is the number of cache files (xxxx-a and xxxx-d) examined.
+	ScannedFiles int64
+	// RemovedFiles and RemovedBytes are the number and the total size of the cache files removed.
+	RemovedFiles, RemovedBytes int64
+	// Duration is the time the trim took; zero if it was skipped
+	// as the trim interval has not elapsed since the last trim.
+	Duration time.Duration
+}
+
+// TrimResult trims the cache as Trim does, and returns what it has done.
+func (C *Cache) TrimResult() (TrimResult, error) {
+	C.trimMu.Lock()
+	defer C.trimUnlock()
+	return C.trim(false)
+}
+
+// maybeTrim trims the cache if the trim interval has elapsed since the last trim.
+func (C *Cache) maybeTrim() {
+	C.trimMu.Lock()
+	defer C.trimUnlock()
+	C.trim(false)
+}
+
+// retryNoSpace calls put, and if it fails as the disk is full,
+// trims the cache immediately and calls put once more.
+func (C *Cache) retryNoSpace(put func() (OutputID, int64, error)) (OutputID, int64, error) {
+	out, n, err := put()
+	if err == nil || !isNoSpace(err) {
+		return out, n, err
+	}
+	C.logger.Warn("disk full, emergency trim", "error", err)
+	C.emergencyTrim()
+	out, n, err = put()
+	if err != nil && isNoSpace(err) {
+		err = fmt.Errorf("%w: %w", ErrNoSpace, err)
+	}
+	return out, n, err
+}
+
+// noSpace trims the cache and wraps err in ErrNoSpace, if it is a disk full error.
+func (C *Cache) noSpace(err error) error {
+	if err == nil || !isNoSpace(err) {
+		return err
+	}
+	C.logger.Warn("disk full, emergency trim", "error", err)
+	C.emergencyTrim()
+	return fmt.Errorf("%w: %w", ErrNoSpace, err)
+}
+
+func isNoSpace(err error) bool { return errors.Is(err, syscall.ENOSPC) }
+
+// emergencyTrim trims the cache regardless of the trim interval,
+// and if that removes nothing, evicts the oldest half of the cache.
+func (C *Cache) emergencyTrim() {
+	C.trimMu.Lock()
+	defer C.trimUnlock()
+	if res, err := C.trim(true); err == nil && res.RemovedFiles != 0 {
+		return
+	}
+	files := C.cacheFiles("-a", "-d")
+	var size int64
+	for _, f := range files {
+		size += f.size
+	}
+	C.truncate(files, size, size/2)
+}
+
+// trimCounts accumulates the TrimResult of the running trim.
+type trimCounts struct {
+	scanned, removed, removedBytes atomic.Int64
+}
+
+// shard returns the lock for the action ID, one for each subdirectory.
+func (C *Cache) shard(id ActionID) *sync.Mutex { return &C.shards[id[0]] }
+
+// trim trims the cache, if the trim interval has elapsed since the last trim, or force is set.
+func (C *Cache) trim(force bool) (res TrimResult, err error) {
+	now := C.now()
+	if !force && !C.lastTrim.IsZero() && now.Sub(C.lastTrim) < C.trimInterval {
+		C.logger.Debug("skip trim", slog.Time("lastTrim", C.lastTrim), slog.String("trimInterval", C.trimInterval.String()))
+		return res, nil
+	}
+
+	trimFn := filepath.Join(C.dir, "trim.txt")
+	// We maintain in dir/trim.txt the time of the last completed cache trim.
+	// If the cache has been trimmed recently enough, do nothing.
+	// This is the common case.
+	// If the trim file is corrupt, detected if the file can't be parsed, or the
+	// trim time is too far in the future, attempt the trim anyway. It's possible that
+	// the cache was full when the corruption happened. Attempting a trim on
+	// an empty cache is cheap, so there wouldn't be a big performance hit in that case.
+	if C.trimInterval > 0 || C.trimSubdirs > 0 {
+		if data, err := lockedfile.Read(trimFn); err == nil {
+			// The optional second field is the cursor of the incremental trim.
+			fields := strings.Fields(string(data))
+			if len(fields) > 1 {
+				if i, err := strconv.Atoi(fields[1]); err == nil && 0 <= i && i < 256 {
+					C.trimCursor = i
+				}
+			}
+			if len(fields) == 0 {
+				fields = []string{""}
+			}
+			if t, err := strconv.ParseInt(fields[0], 10, 64); err == nil && C.trimInterval > 0 {
+				C.lastTrim = time.Unix(t, 0)
+				if !force && now.Sub(C.lastTrim) < C.trimInterval {
+					C.logger.Debug("skip trim", slog.Time("lastTrim", C.lastTrim), slog.String("trimInterval", C.trimInterval.String()))
+					return res, nil
+				}
+			}
+		}
+	}
+
+	start := time.Now()
+	C.trimCounts = trimCounts{}
+	_, span := C.startSpan(context.Background(), "filecache.Trim", ActionID{})
+	defer func() {
+		res.ScannedFiles = C.trimCounts.scanned.Load()
+		res.RemovedFiles = C.trimCounts.removed.Load()
+		res.RemovedBytes = C.trimCounts.removedBytes.Load()
+		res.Duration = time.Since(start)
+		endSpan(span, err, res.RemovedBytes)
+		C.metrics.trimDuration.Add(int64(res.Duration))
+		C.logger.Debug("trimmed", "scanned", res.ScannedFiles, "removed", res.RemovedFiles, "removedBytes", res.RemovedBytes, "duration", res.Duration.String())
+	}()
+
+	// Trim each of the 256 subdirectories,
+	// or only the next trimSubdirs of them in incremental mode.
+	first, n := 0, 256
+	if C.trimSubdirs > 0 && C.trimSubdirs < 256 {
+		first, n = C.trimCursor, C.trimSubdirs
+	}
+	cutoffTime := now.Add(-C.trimLimit)
+	var maxAgeTime time.Time
+	if C.maxAge > 0 {
+		maxAgeTime = now.Add(-C.maxAge)
+	}
+	cutoffSize := C.trimSize
+	sizeCutoffTime := now.Add(-C.trimInterval)
+	// The subdirectories are independent, so scan them concurrently.
+	// Each worker writes distinct elements of subdirSize and subdirCount.
+	subdirs := make(chan int)
+	var wg sync.WaitGroup
+	for w := runtime.GOMAXPROCS(0); w > 0; w-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range subdirs {
+				C.subdirSize[i], C.subdirCount[i] = C.trimSubdir(
+					filepath.Join(C.dir, fmt.Sprintf("%02x", i)),
+					cutoffTime, cutoffSize, sizeCutoffTime, maxAgeTime)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		subdirs <- (first + i) % 256
+	}
+	close(subdirs)
+	wg.Wait()
+	C.trimCursor = (first + n) % 256
+	// In incremental mode, the subdirectories not scanned now are accounted for
+	// with the sizes seen by their last scan.
+	var size, count int64
+	for i := range C.subdirSize {
+		size += C.subdirSize[i]
+		count += C.subdirCount[i]
+	}
+	C.trimPlain(cutoffTime)
+	C.trimTemp(cutoffTime)
+	C.logger.Warn("trim", "size", size, "maxSize", C.maxSize, "count", count, "maxCount", C.maxCount)
+	if C.maxSize > 0 && size > C.maxSize {
+		C.logger.Warn("truncate cache", "maxSize", C.maxSize, "size", size)
+		// Remove only cache entries (xxxx-a and xxxx-d), the oldest first.
+		var removed int64
+		size, removed = C.truncate(C.cacheFiles("-a", "-d"), size, C.maxSize/2)
+		count -= removed
+	}
+	if C.maxCount > 0 && count > C.maxCount {
+		C.logger.Warn("evict oldest", "maxCount", C.maxCount, "count", count)
+		removedSize, removed := C.evictOldest(count - C.maxCount)
+		size, count = size-removedSize, count-removed
+	}
+	C.metrics.size.Store(size)
+	C.metrics.count.Store(count)
+	C.lastTrim = now
+
+	// Ignore errors from here: if we don't write the complete timestamp, the
+	// cache will appear older than it is, and we'll trim it again next time.
+	return res, C.writeTrimFile(now)
+}
+
+// writeTrimFile writes the time of the last trim to dir/trim.txt.
+func (C *Cache) writeTrimFile(now time.Time) error {
+	trimFn := filepath.Join(C.dir, "trim.txt")
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d", now.Unix())
+	if C.trimSubdirs > 0 {
+		fmt.Fprintf(&b, " %d", C.trimCursor)
+	}
+	if err := lockedfile.Write(trimFn, &b, 0666); err != nil {
+		C.logger.Error("write", slog.String("file", trimFn), slog.Any("error", err))
+		return err
+	}
+	return nil
+}
+
+// trimPlain removes the uncompressed copies (see GetFile) not used since cutoffTime.
+func (C *Cache) trimPlain(cutoffTime time.Time) {
+	dir := filepath.Join(C.dir, "plain")
+	dis, _ := os.ReadDir(dir)
+	for _, di := range dis {
+		if fi, err := di.Info(); err == nil && fi.ModTime().Before(cutoffTime) && !C.pinned(di.Name()) {
+			_ = os.Remove(filepath.Join(dir, di.Name()))
+		}
+	}
+}
+
+// trimTemp removes the files of the default temporary directory (see WithTempDir)
+// not modified since cutoffTime.
+func (C *Cache) trimTemp(cutoffTime time.Time) {
+	dir := filepath.Join(C.dir, "tmp")
+	if C.tempDir != dir {
+		return
+	}
+	dis, _ := os.ReadDir(dir)
+	for _, di := range dis {
+		if fi, err := di.Info(); err == nil && fi.Mode().IsRegular() && fi.ModTime().Before(cutoffTime) {
+			_ = os.Remove(filepath.Join(dir, di.Name()))
+		}
+	}
+}
+
+// errModified is returned by evict for the files modified since they have been scanned.
+var errModified = errors.New("modified since the scan")
+
+// evict removes the cache file, scanned with modTime, and records it for the evict callback.
+//
+// An action entry is removed holding the lock of its shard, so it does not race with a Put
+// (or Touch) of the same action ID; and is kept if it has been rewritten (or touched) since the scan.
+func (C *Cache) evict(path string, size int64, modTime time.Time) error {
+	if C.pinned(path) {
+		return fmt.Errorf("%s: %w", path, errPinned)
+	}
+	name := filepath.Base(path)
+	if strings.HasSuffix(name, "-a") {
+		var id ActionID
+		if b, err := hex.DecodeString(strings.TrimSuffix(name, "-a")); err == nil && len(b) == len(id) {
+			copy(id[:], b)
+			mu := C.shard(id)
+			mu.Lock()
+			defer mu.Unlock()
+		}
+	}
+	if fi, err := os.Stat(path); err != nil {
+		return err
+	} else if !fi.ModTime().Equal(modTime) {
+		return fmt.Errorf("%s: %w", path, errModified)
+	}
+	var e evicted
+	if C.onEvict != nil && strings.HasSuffix(name, "-a") {
+		// Read the action entry before it is gone, for its OutputID.
+		b, err := os.ReadFile(path)
+		if err == nil {
+			var entry cache.Entry
+			if e.id, entry, err = parseIndexEntry(b); err == nil {
+				e.action, e.out = true, entry.OutputID
+			}
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	C.trimCounts.removed.Add(1)
+	C.trimCounts.removedBytes.Add(size)
+	switch {
+	case strings.HasSuffix(name, "-d"):
+		C.metrics.evictions.Add(1)
+		b, err := hex.DecodeString(strings.TrimSuffix(name, "-d"))
+		if err != nil || len(b) != len(e.out) {
+			return nil
+		}
+		copy(e.out[:], b)
+		e.size = size
+	case !e.action:
+		return nil
+	}
+	if C.onEvict == nil {
+		return nil
+	}
+	C.evictedMu.Lock()
+	C.evicted = append(C.evicted, e)
+	C.evictedMu.Unlock()
+	return nil
+}
+
+// trimUnlock releases the trim lock, then calls the evict callback
+// for the files removed while it was held (see WithEvictCallback).
+func (C *Cache) trimUnlock() {
+	evicted := C.evicted
+	C.evicted = nil
+	C.trimMu.Unlock()
+	if len(evicted) == 0 {
+		return
+	}
+	// The sizes of the removed data files, not reported yet.
+	sizes := make(map[OutputID]int64)
+	for _, e := range evicted {
+		if !e.action {
+			sizes[e.out] = e.size
+		}
+	}
+	for _, e := range evicted {
+		if e.action {
+			size := sizes[e.out]
+			delete(sizes, e.out)
+			C.onEvict(e.id, e.out, size)
+		}
+	}
+	for _, e := range evicted {
+		if size, ok := sizes[e.out]; ok && !e.action {
+			delete(sizes, e.out)
+			C.onEvict(ActionID{}, e.out, size)
+		}
+	}
+}
+
+// evicted is a file removed by trim: an action entry (with its OutputID), or a data file.
+type evicted struct {
+	id     ActionID
+	out    OutputID
+	size   int64
+	action bool
+}
+
+// cacheFile is a file of the cache directory, as listed by cacheFiles.
+type cacheFile struct {
+	modTime time.Time
+	path    string
+	size    int64
+	subdir  int
+}
+
+// evictFile evicts f, and subtracts it from the sizes recorded for its subdirectory,
+// so the next (incremental) trim does not count it again.
+func (C *Cache) evictFile(f cacheFile) error {
+	if err := C.evict(f.path, f.size, f.modTime); err != nil {
+		return err
+	}
+	C.subdirSize[f.subdir] -= f.size
+	if strings.HasSuffix(f.path, "-d") {
+		C.subdirCount[f.subdir]--
+	}
+	return nil
+}
+
+// cacheFiles returns the files of the subdirectories with any of the given suffixes,
+// the oldest first.
+func (C *Cache) cacheFiles(suffixes ...string) []cacheFile {
+	var files []cacheFile
+	for i := 0; i < 256; i++ {
+		subdir := filepath.Join(C.dir, fmt.Sprintf("%02x", i))
+		dis, _ := os.ReadDir(subdir)
+		for _, di := range dis {
+			name := di.Name()
+			if !slices.ContainsFunc(suffixes, func(suffix string) bool { return strings.HasSuffix(name, suffix) }) {
+				continue
+			}
+			if fi, err := di.Info(); err == nil {
+				files = append(files, cacheFile{path: filepath.Join(subdir, name), modTime: fi.ModTime(), size: fi.Size(), subdir: i})
+			}
+		}
+	}
+	slices.SortFunc(files, func(a, b cacheFile) int { return a.modTime.Compare(b.modTime) })
+	return files
+}
+
+// truncate evicts files, in order, until their total size drops to target.
+// A data file is evicted with the action entries pointing at it (see evictData).
+// It returns the remaining size, and the number of data files removed.
+func (C *Cache) truncate(files []cacheFile, size, target int64) (int64, int64) {
+	actions := actionFiles(files)
+	var removed int64
+	for _, f := range files {
+		if size <= target {
+			break
+		}
+		if !strings.HasSuffix(f.path, "-d") {
+			if C.evictFile(f) == nil {
+				size -= f.size
+			}
+			continue
+		}
+		if n, err := C.evictData(f, actions); err == nil {
+			size -= n
+			removed++
+		}
+	}
+	return size, removed
+}
+
+// evictOldest removes the n oldest data files,
+// and returns their total size and number.
+func (C *Cache) evictOldest(n int64) (int64, int64) {
+	actions := actionFiles(C.cacheFiles("-a"))
+	var size, removed int64
+	for _, f := range C.cacheFiles("-d") {
+		if removed >= n {
+			break
+		}
+		if m, err := C.evictData(f, actions); err == nil {
+			size += m
+			removed++
+		}
+	}
+	return size, removed
+}
+
+// actionFiles reads the action entries among files, and returns them by the output they point at.
+func actionFiles(files []cacheFile) map[OutputID][]cacheFile {
+	actions := make(map[OutputID][]cacheFile)
+	for _, f := range files {
+		if !strings.HasSuffix(f.path, "-a") {
+			continue
+		}
+		b, err := os.ReadFile(f.path)
+		if err != nil {
+			continue
+		}
+		if _, entry, err := parseIndexEntry(b); err == nil {
+			actions[entry.OutputID] = append(actions[entry.OutputID], f)
+		}
+	}
+	return actions
+}
+
+// evictData evicts the data file f, and the action entries pointing at it (see actionFiles),
+// so these do not dangle, and the evict callback gets their ActionIDs.
+// It returns the total size removed.
+func (C *Cache) evictData(f cacheFile, actions map[OutputID][]cacheFile) (int64, error) {
+	if err := C.evictFile(f); err != nil {
+		return 0, err
+	}
+	size := f.size
+	var out OutputID
+	if b, err := hex.DecodeString(strings.TrimSuffix(filepath.Base(f.path), "-d")); err == nil && len(b) == len(out) {
+		copy(out[:], b)
+		for _, a := range actions[out] {
+			if C.evictFile(a) == nil {
+				size += a.size
+			}
+		}
+	}
+	return size, nil
+}
+
+// trimExpiry removes the entry of the expiry file (xxxx-e) if it is expired,
+// or the file itself if its entry is gone;
+// otherwise flags the entry to have sidecars (for the caches written before the flag).
+func (C *Cache) trimExpiry(name string) {
+	var id ActionID
+	b, err := hex.DecodeString(strings.TrimSuffix(name, "-e"))
+	if err != nil || len(b) != len(id) {
+		return
+	}
+	copy(id[:], b)
+	if C.pinned(C.fileName(id, "a")) {
+		return
+	}
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, err := os.Stat(C.fileName(id, "a")); C.isExpired(id) || os.IsNotExist(err) {
+		if err := C.delete(id); err != nil {
+			C.logger.Warn("delete expired", "actionID", fmt.Sprintf("%x", id), "error", err)
+		}
+	} else if err == nil {
+		_ = C.markSidecars(id)
+	}
+}
+
+// putBefore reports whether the action entry file has been Put before t.
+func putBefore(path string, t time.Time) bool {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	_, entry, err := parseIndexEntry(b)
+	return err == nil && entry.Time.Before(t)
+}
+
+// trimSubdir trims a single cache subdirectory,
+// returning the size and the number of the remaining data files.
+// The action entries Put before maxAgeTime (if not zero) are removed, too.
+func (C *Cache) trimSubdir(subdir string, cutoffTime time.Time, cutoffSize int64, sizeCutoffTime, maxAgeTime time.Time) (int64, int64) {
+	// Read all directory entries from subdir before removing
+	// any files, in case removing files invalidates the file offset
+	// in the directory scan. Also, ignore error from f.Readdirnames,
+	// because we don't care about reporting the error and we still
+	// want to process any entries found before the error.
+	f, err := os.Open(subdir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			C.logger.Warn("Open", "subdir", subdir)
+		}
+		return 0, 0
+	}
+	defer f.Close()
+	var size, count int64
+	for {
+		dis, _ := f.ReadDir(128)
+		if len(dis) == 0 {
+			break
+		}
+
+		for _, di := range dis {
+			// C.logger.Info("list", "entry", di.Name())
+			name := di.Name()
+			if strings.HasSuffix(name, "-e") {
+				C.trimExpiry(name)
+				continue
+			}
+			if strings.HasSuffix(name, "-m") {
+				C.trimMeta(name)
+				continue
+			}
+			// Remove only cache entries (xxxx-a and xxxx-d).
+			if !strings.HasSuffix(name, "-a") && !strings.HasSuffix(name, "-d") {
+				continue
+			}
+			entry := filepath.Join(subdir, name)
+			C.trimCounts.scanned.Add(1)
+			info, err := os.Stat(entry)
+			if err != nil {
+				// An expired entry may have been removed by trimExpiry.
+				if !os.IsNotExist(err) {
+					C.logger.Warn("stat", "entry", entry, "error", err)
+				}
+				continue
+			}
+			if (info.ModTime().Before(cutoffTime) ||
+				(cutoffSize > 0 && info.Size() > cutoffSize && info.ModTime().Before(sizeCutoffTime)) ||
+				(!maxAgeTime.IsZero() && strings.HasSuffix(name, "-a") && putBefore(entry, maxAgeTime))) &&
+				C.evict(entry, info.Size(), info.ModTime()) == nil {
+				// C.logger.Info("remove", "entry", entry)
+				continue
+			}
+			// C.logger.Info("keep", "entry", entry, "size", size, "info", info.Size())
+			size += info.Size()
+			if strings.HasSuffix(name, "-d") {
+				count++
 			}
 		}
 	}
-	return size
+	return size, count
 }
@@ -8,17 +8,40 @@
 package filecache_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/UNO-SOFT/filecache"
+	"github.com/rogpeppe/go-internal/cache"
 	"github.com/tgulacsi/go/iohlp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func TestPutTrim(t *testing.T) {
@@ -111,3 +134,2417 @@ func TestPutTrim(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDelete(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := filecache.NewActionID([]byte("delete"))
+	if _, _, err = c.Put(id, strings.NewReader("to be deleted")); err != nil {
+		t.Fatal(err)
+	}
+	fn, _, err := c.GetFile(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.GetFile(id); err == nil {
+		t.Error("entry still exists after Delete")
+	}
+	if _, err = os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("data file %q still exists: %+v", fn, err)
+	}
+	if err = c.Delete(id); err != nil {
+		t.Errorf("Delete of absent entry: %+v", err)
+	}
+}
+
+func TestDeleteEntry(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := filecache.NewActionID([]byte("delete-a")), filecache.NewActionID([]byte("delete-b"))
+	var out filecache.OutputID
+	for _, id := range []filecache.ActionID{a, b} {
+		if out, err = c.PutBytes(id, []byte("shared")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = c.DeleteEntry(a); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.Has(a); err != nil || ok {
+		t.Errorf("Has after DeleteEntry: %t, %+v", ok, err)
+	}
+	if _, err = os.Stat(c.OutputFile(out)); err != nil {
+		t.Errorf("the shared data file has been removed: %+v", err)
+	}
+	if got, _, err := c.GetBytes(b); err != nil || string(got) != "shared" {
+		t.Errorf("GetBytes of the other action: got %q, %+v", got, err)
+	}
+}
+
+func TestHas(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := filecache.NewActionID([]byte("has"))
+	if ok, err := c.Has(id); err != nil || ok {
+		t.Fatalf("Has before Put: %t, %+v", ok, err)
+	}
+	if _, _, err = c.Put(id, strings.NewReader("present")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.Has(id); err != nil || !ok {
+		t.Fatalf("Has after Put: %t, %+v", ok, err)
+	}
+}
+
+func TestClear(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]filecache.ActionID, 0, 5)
+	for _, s := range []string{"a", "bb", "ccc"} {
+		id := filecache.NewActionID([]byte("clear-" + s))
+		if _, err = c.PutBytes(id, []byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// The sidecars go, too.
+	id := filecache.NewActionID([]byte("clear-meta"))
+	if _, _, err = c.PutWithMeta(id, strings.NewReader("dddd"), filecache.Meta{FileName: "d.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids, id)
+	id = filecache.NewActionID([]byte("clear-expiry"))
+	if _, _, err = c.PutWithExpiry(id, strings.NewReader("eeeee"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids, id)
+	if err = c.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if _, _, err = c.GetFile(id); !errors.Is(err, filecache.ErrNotFound) {
+			t.Errorf("GetFile(%x) after Clear: got %+v, wanted ErrNotFound", id, err)
+		}
+	}
+	if _, err = c.GetMeta(ids[3]); !errors.Is(err, filecache.ErrNotFound) {
+		t.Errorf("GetMeta after Clear: got %+v, wanted ErrNotFound", err)
+	}
+	st, err := c.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Count != 0 || st.PhysicalSize != 0 || st.LogicalSize != 0 {
+		t.Errorf("Stats after Clear: got %+v, wanted zero", st)
+	}
+	// The cache is usable after Clear.
+	if _, err = c.PutBytes(ids[0], []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if b, _, err := c.GetBytes(ids[0]); err != nil || string(b) != "again" {
+		t.Errorf("GetBytes after Clear and Put: got %q, %+v", b, err)
+	}
+}
+
+func TestFileName(t *testing.T) {
+	dir := t.TempDir()
+	c, err := filecache.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.Dir(); got != dir {
+		t.Errorf("Dir: got %q, wanted %q", got, dir)
+	}
+	id := filecache.NewActionID([]byte("file name"))
+	data := []byte("data")
+	out, err := c.PutBytes(id, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fn := c.ActionFile(id); fn != filepath.Join(dir, fmt.Sprintf("%02x", id[0]), fmt.Sprintf("%x-a", id)) {
+		t.Errorf("ActionFile: got %q", fn)
+	} else if _, err := os.Stat(fn); err != nil {
+		t.Error(err)
+	}
+	if fn := c.FileName(id); fn != filepath.Join(dir, fmt.Sprintf("%02x", out[0]), fmt.Sprintf("%x-d", out)) {
+		t.Errorf("FileName: got %q", fn)
+	} else if b, err := os.ReadFile(fn); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, data) {
+		t.Errorf("FileName: got %q, wanted %q", b, data)
+	}
+	if fn := c.FileName(filecache.NewActionID([]byte("missing"))); fn != "" {
+		t.Errorf("FileName of a missing entry: got %q, wanted none", fn)
+	}
+	entry, err := c.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.OutputID != out {
+		t.Errorf("got output %x, wanted %x", entry.OutputID, out)
+	}
+	if b, err := os.ReadFile(c.OutputFile(entry.OutputID)); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, data) {
+		t.Errorf("got %q, wanted %q", b, data)
+	}
+}
+
+func TestFS(t *testing.T) {
+	for name, open := range map[string]func(dir string) (*filecache.Cache, error){
+		"plain": func(dir string) (*filecache.Cache, error) { return filecache.Open(dir) },
+		"zstd": func(dir string) (*filecache.Cache, error) {
+			return filecache.Open(dir, filecache.WithCompression(filecache.Zstd))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			var names []string
+			for i := 0; i < 3; i++ {
+				id := filecache.NewActionID([]byte(fmt.Sprintf("fs-%d", i)))
+				if _, err := c.PutBytes(id, bytes.Repeat([]byte{'a' + byte(i)}, 1000)); err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, base64.URLEncoding.EncodeToString(id[:]))
+			}
+			fsys := c.FS()
+			if err := fstest.TestFS(fsys, names...); err != nil {
+				t.Fatal(err)
+			}
+			if b, err := fs.ReadFile(fsys, names[1]); err != nil {
+				t.Fatal(err)
+			} else if want := bytes.Repeat([]byte{'b'}, 1000); !bytes.Equal(b, want) {
+				t.Errorf("got %q, wanted %q", b, want)
+			}
+			if _, err := fs.Stat(fsys, base64.URLEncoding.EncodeToString(make([]byte, 32))); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("got %+v, wanted ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestMeta(t *testing.T) {
+	dir := t.TempDir()
+	c, err := filecache.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id := filecache.NewActionID([]byte("meta"))
+	if _, err := c.GetMeta(id); !errors.Is(err, filecache.ErrNotFound) {
+		t.Errorf("GetMeta of a missing entry: got %+v, wanted ErrNotFound", err)
+	}
+	meta := filecache.Meta{ContentType: "application/json", FileName: "a.json"}
+	if _, _, err := c.PutWithMeta(id, strings.NewReader(`{"a":1}`), meta); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.GetMeta(id); err != nil || got != meta {
+		t.Errorf("got %+v, %+v; wanted %+v", got, err, meta)
+	}
+	// Another output for the same action does not inherit the Meta.
+	if _, err := c.PutBytes(id, []byte(`{"a":2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.GetMeta(id); err != nil || got != (filecache.Meta{}) {
+		t.Errorf("after Put: got %+v, %+v; wanted no Meta", got, err)
+	}
+	if _, _, err := c.PutWithMeta(id, strings.NewReader(`{"a":3}`), meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%02x", id[0]), fmt.Sprintf("%x-m", id))); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("meta file remained after Delete: %+v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range []string{"a", "bb", "ccc"} {
+		if _, err = c.PutBytes(filecache.NewActionID([]byte{byte(i)}), []byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, err := c.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(st)
+	if st.Count != 3 || st.PhysicalSize != 6 || st.LogicalSize != 6 || st.Size != st.PhysicalSize || st.Oldest.IsZero() || st.Newest.Before(st.Oldest) {
+		t.Errorf("got %+v, wanted 3 files of 6 bytes", st)
+	}
+}
+
+func TestMaxCount(t *testing.T) {
+	var evicted []filecache.ActionID
+	c, err := filecache.Open(t.TempDir(),
+		filecache.WithTrimInterval(0),
+		filecache.WithMaxCount(2),
+		filecache.WithEvictCallback(func(id filecache.ActionID, _ filecache.OutputID, _ int64) { evicted = append(evicted, id) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]filecache.ActionID, 5)
+	for i := range ids {
+		ids[i] = filecache.NewActionID([]byte{byte(i)})
+		if _, err = c.PutBytes(ids[i], []byte(fmt.Sprintf("%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := ids[len(ids)-1]
+	// Each Put trims, so only the last one is left for this trim.
+	res, err := c.TrimResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("trim: %+v", res)
+	// The data file goes with its action entry.
+	const entrySize = 2 + 1 + 64 + 1 + 64 + 1 + 20 + 1 + 20 + 1
+	if res.RemovedFiles != 2 || res.RemovedBytes != 3+entrySize {
+		t.Errorf("trim removed %d files (%d bytes), wanted 2 (%d bytes)", res.RemovedFiles, res.RemovedBytes, 3+entrySize)
+	}
+	if st, err := c.Stats(); err != nil {
+		t.Fatal(err)
+	} else if st.Count != 2 {
+		t.Errorf("got %d entries, wanted 2", st.Count)
+	}
+	// The oldest ones are evicted, and reported with their ActionIDs.
+	if !slices.Equal(evicted, ids[:3]) {
+		t.Errorf("evicted %x, wanted %x", evicted, ids[:3])
+	}
+	for _, id := range ids[:3] {
+		if ok, err := c.Has(id); err != nil || ok {
+			t.Errorf("Has(%x) of an evicted entry: %t, %+v", id, ok, err)
+		}
+	}
+	if _, _, err = c.GetFile(last); err != nil {
+		t.Errorf("newest entry has been evicted: %+v", err)
+	}
+}
+
+func TestEvictCallback(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	type call struct {
+		id   filecache.ActionID
+		size int64
+	}
+	var calls []call
+	c, err := filecache.Open(dir,
+		filecache.WithNow(func() time.Time { return now }),
+		filecache.WithTrimLimit(time.Hour),
+		filecache.WithTrimInterval(time.Minute),
+		filecache.WithEvictCallback(func(id filecache.ActionID, out filecache.OutputID, size int64) {
+			calls = append(calls, call{id: id, size: size})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two actions share the output of "shared".
+	ids := make([]filecache.ActionID, 3)
+	for i, s := range []string{"shared", "shared", "single"} {
+		ids[i] = filecache.NewActionID([]byte(strconv.Itoa(i)))
+		out, err := c.PutBytes(ids[i], []byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := now.Add(-2 * time.Hour)
+		for _, fn := range []string{c.ActionFile(ids[i]), c.OutputFile(out)} {
+			if err := os.Chtimes(fn, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	now = now.Add(2 * time.Minute)
+	if err = c.Trim(); err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	got := make(map[filecache.ActionID]bool)
+	for _, c := range calls {
+		got[c.id] = true
+		total += c.size
+	}
+	if len(calls) != 3 || !got[ids[0]] || !got[ids[1]] || !got[ids[2]] {
+		t.Errorf("got %+v, wanted a call for each of %x", calls, ids)
+	}
+	if want := int64(len("shared") + len("single")); total != want {
+		t.Errorf("got %d bytes in total, wanted %d", total, want)
+	}
+}
+
+func TestAutoTrim(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	evicted := make(chan filecache.ActionID, 4)
+	c, err := filecache.Open(t.TempDir(),
+		filecache.WithAutoTrim(ctx),
+		filecache.WithTrimInterval(10*time.Millisecond),
+		filecache.WithTrimLimit(time.Hour),
+		filecache.WithEvictCallback(func(id filecache.ActionID, out filecache.OutputID, size int64) {
+			evicted <- id
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	age := func(id filecache.ActionID, out filecache.OutputID) {
+		t.Helper()
+		old := time.Now().Add(-2 * time.Hour)
+		for _, fn := range []string{c.ActionFile(id), c.OutputFile(out)} {
+			if err := os.Chtimes(fn, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ids := make([]filecache.ActionID, 2)
+	outs := make([]filecache.OutputID, 2)
+	for i := range ids {
+		ids[i] = filecache.NewActionID([]byte("autotrim-" + strconv.Itoa(i)))
+		if outs[i], err = c.PutBytes(ids[i], []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// No Put nor Trim call: only the background trimmer can evict the aged entry.
+	age(ids[0], outs[0])
+	select {
+	case id := <-evicted:
+		if id != ids[0] {
+			t.Errorf("evicted %x, wanted %x", id, ids[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the background trimmer has not evicted the old entry")
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > goroutines; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines after Close, wanted at most %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The stopped trimmer does not evict anymore.
+	age(ids[1], outs[1])
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case id := <-evicted:
+		t.Errorf("evicted %x after Close", id)
+	default:
+	}
+	if _, err = os.Stat(c.ActionFile(ids[1])); err != nil {
+		t.Errorf("entry removed after Close: %+v", err)
+	}
+}
+
+func TestMaxSizeOldestFirst(t *testing.T) {
+	dir := t.TempDir()
+	c, err := filecache.Open(dir, filecache.WithTrimInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// 10 entries, 1 minute apart, of 100 bytes data and 175 bytes action entries.
+	const entries = 10
+	base := time.Now().Add(-time.Hour)
+	ids := make([]filecache.ActionID, entries)
+	for i := range ids {
+		ids[i] = filecache.NewActionID([]byte(fmt.Sprintf("entry-%d", i)))
+		out, err := c.PutBytes(ids[i], []byte(strings.Repeat(fmt.Sprintf("%d", i), 100)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime := base.Add(time.Duration(i) * time.Minute)
+		for _, fn := range []string{
+			filepath.Join(dir, fmt.Sprintf("%02x", ids[i][0]), fmt.Sprintf("%x-a", ids[i])),
+			filepath.Join(dir, fmt.Sprintf("%02x", out[0]), fmt.Sprintf("%x-d", out)),
+		} {
+			if err := os.Chtimes(fn, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Truncating to maxSize/2 = 1000 bytes leaves the 3 newest entries.
+	trimmer, err := filecache.Open(dir, filecache.WithTrimInterval(0), filecache.WithMaxSize(2000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trimmer.Close()
+	if err := trimmer.Trim(); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		_, _, err := c.GetBytes(id)
+		if keep := i >= entries-3; keep && err != nil {
+			t.Errorf("%d. newest entry has been evicted: %+v", i, err)
+		} else if !keep && err == nil {
+			t.Errorf("%d. old entry has been kept", i)
+		}
+	}
+}
+
+func TestMaxSizeTruncate(t *testing.T) {
+	dir := t.TempDir()
+	c, err := filecache.Open(dir, filecache.WithTrimInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// 40 entries of 1000 bytes data and 175 bytes action entries, about twice maxSize.
+	const maxSize = 24_000
+	for i := 0; i < 40; i++ {
+		if _, err := c.PutBytes(
+			filecache.NewActionID([]byte(fmt.Sprintf("entry-%d", i))),
+			[]byte(fmt.Sprintf("%01000d", i)),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diskSize := func() int64 {
+		var size int64
+		_ = filepath.WalkDir(dir, func(path string, di fs.DirEntry, err error) error {
+			if err == nil && (strings.HasSuffix(path, "-a") || strings.HasSuffix(path, "-d")) {
+				if fi, err := di.Info(); err == nil {
+					size += fi.Size()
+				}
+			}
+			return nil
+		})
+		return size
+	}
+	if size := diskSize(); size <= maxSize {
+		t.Fatalf("filled only %d bytes", size)
+	}
+
+	// Two incremental trims cover all subdirectories.
+	trimmer, err := filecache.Open(dir,
+		filecache.WithTrimInterval(0), filecache.WithMaxSize(maxSize), filecache.WithIncrementalTrim(128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trimmer.Close()
+	for i := 0; i < 2; i++ {
+		if err := trimmer.Trim(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size := diskSize(); size > maxSize/2 {
+		t.Errorf("size after truncation is %d, wanted at most %d", size, maxSize/2)
+	}
+	// The sizes recorded by the previous scans must not count the evicted files.
+	for i := 0; i < 2; i++ {
+		res, err := trimmer.TrimResult()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RemovedFiles != 0 {
+			t.Errorf("%d. trim removed %d more files", i, res.RemovedFiles)
+		}
+	}
+}
+
+// noSpaceReader fails the copying passes (each second one after hashing,
+// counted by the seeks to the start) with ENOSPC, fails times.
+type noSpaceReader struct {
+	*bytes.Reader
+	pass, fails int
+}
+
+func (r *noSpaceReader) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		r.pass++
+	}
+	return r.Reader.Seek(offset, whence)
+}
+
+func (r *noSpaceReader) Read(p []byte) (int, error) {
+	if r.pass%2 == 0 && r.fails > 0 {
+		r.fails--
+		return 0, &fs.PathError{Op: "write", Path: "test", Err: syscall.ENOSPC}
+	}
+	return r.Reader.Read(p)
+}
+
+func TestPutNoSpace(t *testing.T) {
+	dir := t.TempDir()
+	c, err := filecache.Open(dir, filecache.WithTrimInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	old := make([]filecache.ActionID, 4)
+	for i := range old {
+		old[i] = filecache.NewActionID([]byte(fmt.Sprintf("old-%d", i)))
+		if _, err := c.PutBytes(old[i], []byte(fmt.Sprintf("%0100d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The copy into the data file fails once: it is retried after an emergency trim.
+	id := filecache.NewActionID([]byte("new"))
+	data := []byte("new content")
+	if _, _, err := c.Put(id, &noSpaceReader{Reader: bytes.NewReader(data), fails: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err := c.GetBytes(id); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %q, %+v; wanted %q", got, err, data)
+	}
+	var kept int
+	for _, id := range old {
+		if ok, _ := c.Has(id); ok {
+			kept++
+		}
+	}
+	if kept == len(old) {
+		t.Error("emergency trim removed nothing")
+	}
+
+	// It fails twice: ErrNoSpace is returned, and no partial data file is left.
+	id = filecache.NewActionID([]byte("full"))
+	data = []byte("no space for this")
+	_, _, err = c.Put(id, &noSpaceReader{Reader: bytes.NewReader(data), fails: 2})
+	if !errors.Is(err, filecache.ErrNoSpace) || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("got %+v, wanted ErrNoSpace", err)
+	}
+	out := filecache.SumID(data)
+	if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%02x", out[0]), fmt.Sprintf("%x-d", out))); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("partial data file: %+v", err)
+	}
+}
+
+func BenchmarkTrim(b *testing.B) {
+	dir := b.TempDir()
+	c, err := filecache.Open(dir, filecache.WithTrimInterval(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	const entries = 100_000
+	for i := 0; i < entries; i++ {
+		fn := filepath.Join(dir, fmt.Sprintf("%02x", i%256), fmt.Sprintf("%064x-d", i))
+		if err := os.WriteFile(fn, []byte("x"), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// The trim scans the subdirectories with GOMAXPROCS workers:
+	// compare the sequential scan with the parallel one.
+	workerCounts := []int{1}
+	if n := runtime.GOMAXPROCS(0); n > 1 {
+		workerCounts = append(workerCounts, n)
+	}
+	for _, workers := range workerCounts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(workers))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.Trim(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestHandler exercises the GET, HEAD, POST and DELETE requests of the Handler,
+// with the fetch on miss and the put callback.
+func TestHandler(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var fetched, stored atomic.Int32
+	fetchedID := filecache.NewActionID([]byte("fetched"))
+	srv := httptest.NewServer(http.StripPrefix("/cache", c.Handler(
+		filecache.WithFetchOnMiss(func(ctx context.Context, id filecache.ActionID) error {
+			fetched.Add(1)
+			if id != fetchedID {
+				return filecache.ErrNotFound
+			}
+			_, err := c.PutBytes(id, []byte("from upstream"))
+			return err
+		}),
+		filecache.WithPutCallback(func(filecache.ActionID) { stored.Add(1) }),
+	)))
+	defer srv.Close()
+	do := func(method string, id filecache.ActionID, body string) (int, string) {
+		t.Helper()
+		var r io.Reader
+		if body != "" {
+			r = strings.NewReader(body)
+		}
+		req, err := http.NewRequest(method, srv.URL+"/cache/"+base64.URLEncoding.EncodeToString(id[:]), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	id := filecache.NewActionID([]byte("handler"))
+	if code, _ := do("GET", id, ""); code != http.StatusNotFound {
+		t.Errorf("GET before POST: got %d", code)
+	}
+	if code, body := do("POST", id, "content"); code != http.StatusCreated {
+		t.Fatalf("POST: got %d %q", code, body)
+	}
+	if code, body := do("GET", id, ""); code != http.StatusOK || body != "content" {
+		t.Errorf("GET: got %d %q", code, body)
+	}
+	if code, _ := do("HEAD", id, ""); code != http.StatusOK {
+		t.Errorf("HEAD: got %d", code)
+	}
+	typedID := filecache.NewActionID([]byte("typed"))
+	req, err := http.NewRequest("POST", srv.URL+"/cache/"+base64.URLEncoding.EncodeToString(typedID[:]), strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Disposition", `attachment; filename="x.json"`)
+	if resp, err := srv.Client().Do(req); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+	if resp, err := srv.Client().Get(req.URL.String()); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+		if ct, cd := resp.Header.Get("Content-Type"), resp.Header.Get("Content-Disposition"); ct != "application/json" || cd != `attachment; filename=x.json` {
+			t.Errorf("got Content-Type %q, Content-Disposition %q", ct, cd)
+		}
+	}
+	if code, body := do("GET", fetchedID, ""); code != http.StatusOK || body != "from upstream" {
+		t.Errorf("GET fetched: got %d %q", code, body)
+	}
+	if code, _ := do("DELETE", id, ""); code != http.StatusNoContent {
+		t.Errorf("DELETE: got %d", code)
+	}
+	if code, _ := do("DELETE", id, ""); code != http.StatusNotFound {
+		t.Errorf("second DELETE: got %d", code)
+	}
+	if n := fetched.Load(); n != 2 {
+		t.Errorf("fetched %d times, wanted 2", n)
+	}
+	for i := 0; i < 100 && stored.Load() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := stored.Load(); n != 2 {
+		t.Errorf("put callback called %d times, wanted 2", n)
+	}
+
+	resp, err := srv.Client().Get(srv.URL + "/cache/_healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("healthz: %s", resp.Status)
+	}
+
+	resp, err = srv.Client().Post(srv.URL+"/cache/_trim", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res filecache.TrimResult
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || res.ScannedFiles == 0 || res.Duration == 0 {
+		t.Errorf("trim: %s %+v", resp.Status, res)
+	}
+}
+
+func TestHandlerHead(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	id := filecache.NewActionID([]byte("head"))
+	if _, err = c.PutBytes(id, bytes.Repeat([]byte("content "), 100)); err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, acceptEncoding, ifNoneMatch string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+"/"+base64.URLEncoding.EncodeToString(id[:]), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	for _, ae := range []string{"identity", "gzip"} {
+		get, head := do("GET", ae, ""), do("HEAD", ae, "")
+		if get.StatusCode != http.StatusOK || head.StatusCode != http.StatusOK {
+			t.Fatalf("%s: GET %s, HEAD %s", ae, get.Status, head.Status)
+		}
+		for _, k := range []string{"ETag", "Content-Encoding", "Content-Length", "Vary"} {
+			g, h := get.Header.Get(k), head.Header.Get(k)
+			if k == "Content-Length" && h == "" {
+				// Not known for the content compressed on the fly
+				// (net/http sets it for a small GET body).
+				continue
+			}
+			if g != h {
+				t.Errorf("%s: %s of GET %q, of HEAD %q", ae, k, g, h)
+			}
+		}
+		etag := get.Header.Get("ETag")
+		if resp := do("HEAD", ae, etag); resp.StatusCode != http.StatusNotModified {
+			t.Errorf("%s: HEAD with If-None-Match %s: got %s", ae, etag, resp.Status)
+		}
+	}
+}
+
+func TestHandlerCoalescePOST(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	const n = 8
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	hndl := c.Handler()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		hndl.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	id := filecache.NewActionID([]byte("coalesce"))
+	url := srv.URL + "/" + base64.URLEncoding.EncodeToString(id[:])
+	data := bytes.Repeat([]byte("data"), 1<<10)
+	bodies := make([]*io.PipeWriter, n)
+	codes := make(chan int, n)
+	for i := range bodies {
+		pr, pw := io.Pipe()
+		bodies[i] = pw
+		go func() {
+			resp, err := srv.Client().Post(url, "application/octet-stream", pr)
+			if err != nil {
+				t.Error(err)
+				codes <- 0
+				return
+			}
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}()
+	}
+	// Write the bodies only when all the requests are in, so they are concurrent.
+	arrived.Wait()
+	time.Sleep(100 * time.Millisecond)
+	for _, pw := range bodies {
+		go func() {
+			_, _ = pw.Write(data)
+			pw.Close()
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if code := <-codes; code != http.StatusCreated {
+			t.Errorf("got %d, wanted 201", code)
+		}
+	}
+	if puts := c.Metrics().Puts; puts != 1 {
+		t.Errorf("stored %d times, wanted once", puts)
+	}
+	if got, _, err := c.GetBytes(id); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, %+v", len(got), err)
+	}
+}
+
+func TestHandlerMaxUploadSize(t *testing.T) {
+	c, err := filecache.Open(t.TempDir(), filecache.WithTrimSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name string
+		size int
+		// chunked hides the Content-Length, so the body is cut while reading.
+		chunked bool
+		code    int
+	}{
+		{"fits", 1 << 10, false, http.StatusCreated},
+		{"large", 1<<10 + 1, false, http.StatusRequestEntityTooLarge},
+		{"large chunked", 1<<10 + 1, true, http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			id := filecache.NewActionID([]byte(tc.name))
+			var body io.Reader = bytes.NewReader(bytes.Repeat([]byte{'x'}, tc.size))
+			if tc.chunked {
+				body = struct{ io.Reader }{body}
+			}
+			resp, err := srv.Client().Post(srv.URL+"/"+base64.URLEncoding.EncodeToString(id[:]), "application/octet-stream", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.code {
+				t.Errorf("got %d, wanted %d", resp.StatusCode, tc.code)
+			}
+			if ok, _ := c.Has(id); ok != (tc.code == http.StatusCreated) {
+				t.Errorf("stored: %t", ok)
+			}
+		})
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(c.TempDir(), "*")); len(tmps) != 0 {
+		t.Errorf("temporary files left: %q", tmps)
+	}
+}
+
+func TestHandlerBazel(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	srv := httptest.NewServer(c.Handler(filecache.WithBazel(true)))
+	defer srv.Close()
+	do := func(method, path string, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	content := "content"
+	digest := fmt.Sprintf("%x", filecache.SumID([]byte(content)))
+	if code, _ := do("GET", "/cas/"+digest, ""); code != http.StatusNotFound {
+		t.Errorf("GET a missing content: got %d", code)
+	}
+	if code, body := do("PUT", "/cas/"+digest, "another"); code != http.StatusBadRequest {
+		t.Errorf("PUT a mismatching content: got %d %q", code, body)
+	}
+	if ok, _ := c.Has(filecache.BazelCASActionID(filecache.OutputID(filecache.SumID([]byte(content))))); ok {
+		t.Error("mismatching content is stored")
+	}
+	if code, body := do("PUT", "/cas/"+digest, content); code != http.StatusOK {
+		t.Errorf("PUT content: got %d %q", code, body)
+	}
+	if code, body := do("GET", "/cas/"+digest, ""); code != http.StatusOK || body != content {
+		t.Errorf("GET content: got %d %q", code, body)
+	}
+
+	// The digest of an action may be a content digest, too: they do not collide.
+	if code, _ := do("GET", "/ac/"+digest, ""); code != http.StatusNotFound {
+		t.Errorf("GET a missing action result: got %d", code)
+	}
+	if code, body := do("PUT", "/ac/"+digest, "result"); code != http.StatusOK {
+		t.Errorf("PUT action result: got %d %q", code, body)
+	}
+	if code, body := do("GET", "/ac/"+digest, ""); code != http.StatusOK || body != "result" {
+		t.Errorf("GET action result: got %d %q", code, body)
+	}
+	if code, body := do("GET", "/cas/"+digest, ""); code != http.StatusOK || body != content {
+		t.Errorf("GET content after the action result: got %d %q", code, body)
+	}
+	if code, _ := do("HEAD", "/ac/"+digest, ""); code != http.StatusOK {
+		t.Errorf("HEAD action result: got %d", code)
+	}
+	if code, _ := do("GET", "/ac/xyz", ""); code != http.StatusBadRequest {
+		t.Errorf("GET a bad digest: got %d", code)
+	}
+}
+
+// BenchmarkServe serves a 1GiB plain entry with the Handler (http.ServeContent),
+// which can use sendfile(2) with the *os.File of GetReader,
+// and with a plain copy, hiding the ReadFrom of the http.ResponseWriter.
+func BenchmarkServe(b *testing.B) {
+	c, err := filecache.Open(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	const size = 1 << 30
+	id := filecache.NewActionID([]byte("large"))
+	if _, _, err = c.PutReader(id, io.LimitReader(zeroReader{}, size)); err != nil {
+		b.Fatal(err)
+	}
+	hndl := c.Handler()
+
+	for _, sendfile := range []bool{true, false} {
+		b.Run(fmt.Sprintf("sendfile=%t", sendfile), func(b *testing.B) {
+			h := hndl
+			if !sendfile {
+				h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					// Hide the ReadFrom of w, so no sendfile fast path is possible.
+					hndl.ServeHTTP(struct{ http.ResponseWriter }{w}, r)
+				})
+			}
+			srv := httptest.NewServer(h)
+			defer srv.Close()
+			url := srv.URL + "/" + base64.URLEncoding.EncodeToString(id[:])
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := srv.Client().Get(url)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil || n != size {
+					b.Fatalf("got %d bytes (%s): %+v", n, resp.Status, err)
+				}
+			}
+		})
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestGetOrPut(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := filecache.NewActionID([]byte("GetOrPut"))
+	var computed atomic.Int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			rc, err := c.GetOrPut(id, func() (io.ReadSeeker, error) {
+				computed.Add(1)
+				time.Sleep(100 * time.Millisecond)
+				return strings.NewReader("computed"), nil
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rc.Close()
+			if b, err := io.ReadAll(rc); err != nil {
+				t.Error(err)
+			} else if string(b) != "computed" {
+				t.Errorf("got %q", b)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if n := computed.Load(); n != 1 {
+		t.Errorf("computed %d times, wanted once", n)
+	}
+}
+
+func TestSource(t *testing.T) {
+	known := filecache.NewActionID([]byte("source"))
+	var fetched atomic.Int32
+	c, err := filecache.Open(t.TempDir(), filecache.WithSource(func(ctx context.Context, id filecache.ActionID) (io.ReadCloser, error) {
+		if id != known {
+			return nil, filecache.ErrNotFound
+		}
+		fetched.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		return io.NopCloser(strings.NewReader("fetched")), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			rc, _, err := c.GetReader(known)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rc.Close()
+			if b, err := io.ReadAll(rc); err != nil {
+				t.Error(err)
+			} else if string(b) != "fetched" {
+				t.Errorf("got %q", b)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if n := fetched.Load(); n != 1 {
+		t.Errorf("fetched %d times, wanted once", n)
+	}
+	if b, _, err := c.GetBytes(known); err != nil || string(b) != "fetched" {
+		t.Errorf("GetBytes: got %q, %+v", b, err)
+	}
+
+	if _, _, err := c.GetFile(filecache.NewActionID([]byte("unknown"))); !errors.Is(err, filecache.ErrNotFound) {
+		t.Errorf("unknown: got %+v, wanted ErrNotFound", err)
+	}
+}
+
+// memBlobStore is a BlobStore in memory.
+type memBlobStore struct {
+	mu    sync.Mutex
+	blobs map[filecache.ActionID][]byte
+}
+
+func (m *memBlobStore) Get(ctx context.Context, id filecache.ActionID) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.blobs[id]
+	if !ok {
+		return nil, filecache.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *memBlobStore) Put(ctx context.Context, id filecache.ActionID, r io.Reader, size int64) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) != size {
+		return fmt.Errorf("got %d bytes, wanted %d", len(b), size)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[id] = b
+	return nil
+}
+
+func (m *memBlobStore) Head(ctx context.Context, id filecache.ActionID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.blobs[id]
+	return ok, nil
+}
+
+func TestBlobStore(t *testing.T) {
+	bs := &memBlobStore{blobs: make(map[filecache.ActionID][]byte)}
+	c, err := filecache.Open(t.TempDir(), filecache.WithBlobStore(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := filecache.NewActionID([]byte("kept"))
+	expiring := filecache.NewActionID([]byte("expiring"))
+	if _, err := c.PutBytes(kept, []byte("uploaded")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.PutWithExpiry(expiring, strings.NewReader("local"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b := bs.blobs[kept]; string(b) != "uploaded" {
+		t.Errorf("uploaded %q", b)
+	}
+	if _, ok := bs.blobs[expiring]; ok {
+		t.Error("the expiring entry has been uploaded")
+	}
+
+	// The entry deleted locally is fetched from the BlobStore.
+	c, err = filecache.Open(t.TempDir(), filecache.WithBlobStore(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if b, _, err := c.GetBytes(kept); err != nil || string(b) != "uploaded" {
+		t.Errorf("GetBytes: got %q, %+v", b, err)
+	}
+	if ok, err := c.Has(kept); err != nil || !ok {
+		t.Errorf("not stored locally: %t, %+v", ok, err)
+	}
+	if _, _, err := c.GetBytes(expiring); !errors.Is(err, filecache.ErrNotFound) {
+		t.Errorf("expiring: got %+v, wanted ErrNotFound", err)
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	now := time.Now()
+	c, err := filecache.Open(t.TempDir(),
+		filecache.WithNow(func() time.Time { return now }),
+		filecache.WithTrimLimit(time.Hour),
+		filecache.WithTrimInterval(time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id := filecache.NewActionID([]byte("acquire"))
+	if _, _, err = c.Acquire(id); !errors.Is(err, filecache.ErrNotFound) {
+		t.Errorf("Acquire before Put: got %+v, wanted ErrNotFound", err)
+	}
+	if _, err = c.PutBytes(id, []byte("pinned")); err != nil {
+		t.Fatal(err)
+	}
+	path, release, err := c.Acquire(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, release2, err := c.Acquire(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trim := func() {
+		t.Helper()
+		now = now.Add(2 * time.Hour)
+		if err := c.Trim(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trim()
+	release()
+	release() // idempotent
+	trim()
+	if b, err := os.ReadFile(path); err != nil || string(b) != "pinned" {
+		t.Fatalf("pinned entry trimmed: %q, %+v", b, err)
+	}
+	if ok, err := c.Has(id); err != nil || !ok {
+		t.Errorf("pinned entry trimmed: %t, %+v", ok, err)
+	}
+
+	release2()
+	trim()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("released entry not trimmed: %+v", err)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	present := filecache.NewActionID([]byte("present"))
+	remote := filecache.NewActionID([]byte("remote"))
+	missing := filecache.NewActionID([]byte("missing"))
+	broken := filecache.NewActionID([]byte("broken"))
+	if _, err = c.PutBytes(present, []byte("local")); err != nil {
+		t.Fatal(err)
+	}
+	errBroken := errors.New("broken")
+	source := func(ctx context.Context, id filecache.ActionID) (io.ReadCloser, error) {
+		switch id {
+		case remote:
+			return io.NopCloser(strings.NewReader("fetched")), nil
+		case broken:
+			return nil, errBroken
+		}
+		return nil, filecache.ErrNotFound
+	}
+	ids := []filecache.ActionID{present, remote, missing, broken}
+	results, err := c.Warm(context.Background(), ids, source)
+	if !errors.Is(err, errBroken) {
+		t.Errorf("got %+v, wanted %v", err, errBroken)
+	}
+	want := []filecache.WarmStatus{filecache.WarmPresent, filecache.WarmFetched, filecache.WarmMissing, filecache.WarmFailed}
+	for i, res := range results {
+		if res.ID != ids[i] || res.Status != want[i] {
+			t.Errorf("%d: got %x %s, wanted %x %s", i, res.ID, res.Status, ids[i], want[i])
+		}
+	}
+	if b, _, err := c.GetBytes(remote); err != nil || string(b) != "fetched" {
+		t.Errorf("GetBytes: got %q, %+v", b, err)
+	}
+
+	// Without source, only the local entries are looked up.
+	if results, err = c.Warm(context.Background(), ids[1:3], nil); err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != filecache.WarmPresent || results[1].Status != filecache.WarmMissing {
+		t.Errorf("without source: got %+v", results)
+	}
+}
+
+func TestRendezvous(t *testing.T) {
+	nodes := []string{"a", "b", "c", "d"}
+	owned := make([]int, len(nodes))
+	for i := 0; i < 1000; i++ {
+		id := filecache.NewActionID([]byte(strconv.Itoa(i)))
+		order := filecache.Rendezvous(id, nodes)
+		got := slices.Clone(order)
+		slices.Sort(got)
+		if !slices.Equal(got, []int{0, 1, 2, 3}) {
+			t.Fatalf("%d: not a permutation: %v", i, order)
+		}
+		if again := filecache.Rendezvous(id, nodes); !slices.Equal(again, order) {
+			t.Fatalf("%d: got %v, then %v", i, order, again)
+		}
+		owned[order[0]]++
+		// Without the last node, only its action IDs move (to their second choice).
+		want := order[0]
+		if want == 3 {
+			want = order[1]
+		}
+		if got := filecache.Rendezvous(id, nodes[:3])[0]; got != want {
+			t.Errorf("%d: without d, owner is %d, wanted %d", i, got, want)
+		}
+	}
+	for i, n := range owned {
+		if n < 150 {
+			t.Errorf("%s owns only %d of 1000", nodes[i], n)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	c, err := filecache.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ids := make([]filecache.ActionID, 3)
+	outs := make([]filecache.OutputID, len(ids))
+	for i := range ids {
+		ids[i] = filecache.NewActionID([]byte("verify" + strconv.Itoa(i)))
+		if outs[i], err = c.PutBytes(ids[i], []byte("content"+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Corrupt the first, remove the data file of the second,
+	// and add a data file without an action entry.
+	if err := os.WriteFile(c.OutputFile(outs[0]), []byte("CONTENT0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(c.OutputFile(outs[1])); err != nil {
+		t.Fatal(err)
+	}
+	orphan := c.OutputFile(filecache.OutputID(filecache.SumID([]byte("orphan"))))
+	if err := os.WriteFile(orphan, []byte("orphan"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, fn := range []string{orphan, c.ActionFile(ids[1])} {
+		if err := os.Chtimes(fn, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := c.Verify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Scanned != 6 || res.OK != 1 || res.Corrupt != 1 || res.Orphan != 2 {
+		t.Errorf("got %+v, wanted 6 scanned, 1 ok, 1 corrupt and 2 orphans", res)
+	}
+	if _, err := os.Stat(orphan); err != nil {
+		t.Errorf("removed without repair: %+v", err)
+	}
+
+	if res, err = c.Verify(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range res.Problems {
+		if !p.Removed {
+			t.Errorf("not removed: %+v", p)
+		}
+	}
+	if res, err = c.Verify(false); err != nil {
+		t.Fatal(err)
+	} else if len(res.Problems) != 0 || res.OK != 1 {
+		t.Errorf("after repair: %+v", res)
+	}
+	if got, _, err := c.GetBytes(ids[2]); err != nil || string(got) != "content2" {
+		t.Errorf("the good entry: got %q, %+v", got, err)
+	}
+}
+
+// recordingTracer records the spans started, with the trace ID of their parents.
+type recordingTracer struct {
+	noop.Tracer
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	noop.Span
+	name    string
+	traceID trace.TraceID
+	attrs   map[attribute.Key]attribute.Value
+	ended   bool
+}
+
+func (rt *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	span := &recordedSpan{name: name, traceID: trace.SpanContextFromContext(ctx).TraceID(),
+		attrs: make(map[attribute.Key]attribute.Value)}
+	cfg := trace.NewSpanStartConfig(opts...)
+	span.SetAttributes(cfg.Attributes()...)
+	rt.mu.Lock()
+	rt.spans = append(rt.spans, span)
+	rt.mu.Unlock()
+	return ctx, span
+}
+
+func (s *recordedSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, a := range kv {
+		s.attrs[a.Key] = a.Value
+	}
+}
+func (s *recordedSpan) End(...trace.SpanEndOption) { s.ended = true }
+
+func TestTracer(t *testing.T) {
+	var tracer recordingTracer
+	c, err := filecache.Open(t.TempDir(), filecache.WithTracer(&tracer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id := filecache.NewActionID([]byte("traced"))
+	if _, err := c.PutBytes(id, []byte("traced")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.GetBytes(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(filecache.NewActionID([]byte("missing"))); err == nil {
+		t.Fatal("found the missing")
+	}
+
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+	req, err := http.NewRequest("GET", srv.URL+"/"+base64.URLEncoding.EncodeToString(id[:]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	idHex := fmt.Sprintf("%x", id)
+	want := []struct {
+		name  string
+		hit   string
+		trace string
+	}{
+		{"filecache.PutBytes", "", ""},
+		{"filecache.Trim", "", ""}, // by PutBytes
+		{"filecache.GetBytes", "true", ""},
+		{"filecache.Get", "false", ""},
+		{"filecache.GetEncodedReader", "true", "4bf92f3577b34da6a3ce929d0e0e4736"},
+	}
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	var got []string
+	for _, s := range tracer.spans {
+		got = append(got, s.name)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %q", got)
+	}
+	for i, w := range want {
+		s := tracer.spans[i]
+		if s.name != w.name || !s.ended {
+			t.Errorf("%d. got %q (ended: %t), wanted %q", i, s.name, s.ended, w.name)
+		}
+		if w.hit != "" && s.attrs["filecache.hit"].Emit() != w.hit {
+			t.Errorf("%s: hit=%q, wanted %q", s.name, s.attrs["filecache.hit"].Emit(), w.hit)
+		}
+		if s.name != "filecache.Trim" && s.name != "filecache.Get" && s.attrs["filecache.action_id"].AsString() != idHex {
+			t.Errorf("%s: action_id=%q", s.name, s.attrs["filecache.action_id"].AsString())
+		}
+		if w.trace != "" && s.traceID.String() != w.trace {
+			t.Errorf("%s: trace=%s, wanted %s", s.name, s.traceID, w.trace)
+		}
+	}
+}
+
+func TestPutFile(t *testing.T) {
+	dir := t.TempDir()
+	c, err := filecache.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "input.txt")
+	if err = os.WriteFile(fn, []byte("hardlinked"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id := filecache.NewActionID([]byte("PutFile"))
+	if _, n, err := c.PutFile(id, fn); err != nil {
+		t.Fatal(err)
+	} else if n != 10 {
+		t.Errorf("got size %d, wanted 10", n)
+	}
+	if err = os.Remove(fn); err != nil {
+		t.Fatal(err)
+	}
+	if b, _, err := c.GetBytes(id); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "hardlinked" {
+		t.Errorf("got %q", b)
+	}
+}
+
+func TestVerifyOnGet(t *testing.T) {
+	c, err := filecache.Open(t.TempDir(), filecache.WithVerifyOnGet(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := filecache.NewActionID([]byte("verify"))
+	if _, err = c.PutBytes(id, []byte("original")); err != nil {
+		t.Fatal(err)
+	}
+	fn, _, err := c.GetFile(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(fn, []byte("bitrot!!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.GetFile(id); !errors.Is(err, filecache.ErrCorrupt) {
+		t.Errorf("got %+v, wanted ErrCorrupt", err)
+	}
+	if ok, err := c.Has(id); err != nil || ok {
+		t.Errorf("corrupt entry remained: %t, %+v", ok, err)
+	}
+}
+
+func TestPutWithExpiry(t *testing.T) {
+	now := time.Now()
+	c, err := filecache.Open(t.TempDir(),
+		filecache.WithNow(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := filecache.NewActionID([]byte("expiry"))
+	if _, _, err = c.PutWithExpiry(id, strings.NewReader("short lived"), now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.GetFile(id); err != nil {
+		t.Fatalf("before expiry: %+v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, _, err = c.GetFile(id); !errors.Is(err, filecache.ErrNotFound) {
+		t.Errorf("after expiry: got %+v, wanted ErrNotFound", err)
+	}
+
+	// Put without expiry resets it.
+	if _, _, err = c.PutWithExpiry(id, strings.NewReader("short lived"), now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.Put(id, strings.NewReader("long lived")); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, _, err = c.GetFile(id); err != nil {
+		t.Errorf("Put did not reset expiry: %+v", err)
+	}
+}
+
+func TestSidecarsFlag(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	c, err := filecache.Open(dir,
+		filecache.WithNow(func() time.Time { return now }),
+		filecache.WithTrimInterval(0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, expiring := filecache.NewActionID([]byte("plain")), filecache.NewActionID([]byte("expiring"))
+	if _, _, err = c.Put(plain, strings.NewReader("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.PutWithExpiry(expiring, strings.NewReader("expiring"), now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// The flagged action entry is still readable by the underlying cache.
+	gc, err := cache.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []filecache.ActionID{plain, expiring} {
+		if entry, err := gc.Get(id); err != nil || entry.Size == 0 {
+			t.Errorf("underlying Get(%x): %+v, %+v", id, entry, err)
+		}
+	}
+
+	// An expiry sidecar of an entry not flagged (as of a cache written before the flag)
+	// is not looked at by Get, till a trim flags the entry.
+	fi, err := os.Stat(c.ActionFile(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expFn := strings.TrimSuffix(c.ActionFile(plain), "-a") + "-e"
+	if err = os.WriteFile(expFn, []byte(strconv.FormatInt(now.Add(time.Minute).UnixNano(), 10)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, _, err = c.GetBytes(plain); err != nil {
+		t.Errorf("not flagged: %+v", err)
+	}
+	if _, _, err = c.GetBytes(expiring); !errors.Is(err, filecache.ErrNotFound) {
+		t.Errorf("flagged: got %+v, wanted ErrNotFound", err)
+	}
+	if err = os.WriteFile(expFn, []byte(strconv.FormatInt(now.Add(time.Minute).UnixNano(), 10)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Trim(); err != nil {
+		t.Fatal(err)
+	}
+	if fi2, err := os.Stat(c.ActionFile(plain)); err != nil {
+		t.Fatal(err)
+	} else if !fi2.ModTime().Equal(fi.ModTime()) {
+		t.Errorf("the flagging changed the modification time from %v to %v", fi.ModTime(), fi2.ModTime())
+	}
+	now = now.Add(2 * time.Minute)
+	if _, _, err = c.GetBytes(plain); !errors.Is(err, filecache.ErrNotFound) {
+		t.Errorf("flagged by trim: got %+v, wanted ErrNotFound", err)
+	}
+
+	// A Put of the same output rewrites the action entry, but keeps the Meta.
+	id := filecache.NewActionID([]byte("meta"))
+	meta := filecache.Meta{ContentType: "text/plain"}
+	if _, _, err = c.PutWithMeta(id, strings.NewReader("meta"), meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.Put(id, strings.NewReader("meta")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.GetMeta(id); err != nil || got != meta {
+		t.Errorf("GetMeta after Put: got %+v, %+v; wanted %+v", got, err, meta)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	want := strings.Repeat("compressible ", 1000)
+	id := filecache.NewActionID([]byte("compression"))
+	for _, codec := range []filecache.Codec{filecache.Gzip, filecache.Zstd} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			c, err := filecache.Open(dir, filecache.WithCompression(codec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, n, err := c.Put(id, strings.NewReader(want)); err != nil {
+				t.Fatal(err)
+			} else if n != int64(len(want)) {
+				t.Errorf("got size %d, wanted %d", n, len(want))
+			}
+			if st, err := c.Stats(); err != nil {
+				t.Fatal(err)
+			} else if st.PhysicalSize >= int64(len(want)) {
+				t.Errorf("stored %d bytes, not compressed", st.PhysicalSize)
+			} else if st.LogicalSize != int64(len(want)) {
+				t.Errorf("got logical size %d, wanted %d", st.LogicalSize, len(want))
+			}
+
+			// Without compression, the compressed entry is still readable.
+			plain, err := filecache.Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range []*filecache.Cache{c, plain} {
+				if b, _, err := c.GetBytes(id); err != nil {
+					t.Fatal(err)
+				} else if string(b) != want {
+					t.Errorf("GetBytes: got %q", b)
+				}
+				rc, _, err := c.GetReader(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatal(err)
+				} else if string(b) != want {
+					t.Errorf("GetReader: got %q", b)
+				}
+				fn, _, err := c.GetFile(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b, err = os.ReadFile(fn); err != nil {
+					t.Fatal(err)
+				} else if string(b) != want {
+					t.Errorf("GetFile: got %q", b)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	key, wrongKey := [32]byte{1, 2, 3}, [32]byte{3, 2, 1}
+	for i, want := range []string{
+		"secret",
+		strings.Repeat("0123456789abcdef", 2*(64<<10)/16), // exactly two chunks
+		strings.Repeat("secret ", 100_000),
+	} {
+		id := filecache.NewActionID([]byte(fmt.Sprintf("encryption-%d", i)))
+		for _, codec := range []filecache.Codec{nil, filecache.Zstd} {
+			c, err := filecache.Open(dir, filecache.WithEncryption(key), filecache.WithCompression(codec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err = c.Put(id, strings.NewReader(want)); err != nil {
+				t.Fatal(err)
+			}
+			if b, _, err := c.GetBytes(id); err != nil {
+				t.Fatal(err)
+			} else if string(b) != want {
+				t.Errorf("%d. got %d bytes, wanted %d", i, len(b), len(want))
+			}
+
+			wrong, err := filecache.Open(dir, filecache.WithEncryption(wrongKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err = wrong.GetBytes(id); !errors.Is(err, filecache.ErrAuthentication) {
+				t.Errorf("%d. wrong key: got %+v, wanted ErrAuthentication", i, err)
+			}
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	c, err := filecache.Open(t.TempDir(), filecache.WithTrimInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := filecache.NewActionID([]byte("metrics"))
+	if _, _, err = c.GetBytes(id); !errors.Is(err, filecache.ErrNotFound) {
+		t.Fatalf("GetBytes before Put: %+v", err)
+	}
+	if _, _, err = c.Put(id, strings.NewReader("counted")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.GetBytes(id); err != nil {
+		t.Fatal(err)
+	}
+	m := c.Metrics()
+	t.Logf("metrics: %+v", m)
+	if m.Hits != 1 || m.Misses != 1 || m.Puts != 1 || m.BytesServed != int64(len("counted")) {
+		t.Errorf("got %+v", m)
+	}
+
+	// The sizes are those seen by the last trim.
+	if err = c.Trim(); err != nil {
+		t.Fatal(err)
+	}
+	if m = c.Metrics(); m.Count != 1 || m.Size <= int64(len("counted")) {
+		t.Errorf("after Trim: got %+v, wanted 1 data file and its action entry", m)
+	}
+	w := httptest.NewRecorder()
+	c.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/_metrics", nil))
+	if body := w.Body.String(); !strings.Contains(body, "\nfilecache_files 1\n") ||
+		!strings.Contains(body, "\nfilecache_size_bytes "+strconv.FormatInt(m.Size, 10)+"\n") {
+		t.Errorf("got metrics %s", body)
+	}
+}
+
+func TestRange(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[filecache.ActionID]int64)
+	for _, s := range []string{"a", "bb", "ccc"} {
+		id := filecache.NewActionID([]byte(s))
+		if _, _, err = c.Put(id, strings.NewReader(s)); err != nil {
+			t.Fatal(err)
+		}
+		want[id] = int64(len(s))
+	}
+	got := make(map[filecache.ActionID]int64)
+	if err = c.Range(func(id filecache.ActionID, entry cache.Entry) bool {
+		got[id] = entry.Size
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, wanted %d", len(got), len(want))
+	}
+	for id, size := range want {
+		if got[id] != size {
+			t.Errorf("%x: got size %d, wanted %d", id, got[id], size)
+		}
+	}
+
+	var n int
+	if err = c.Range(func(filecache.ActionID, cache.Entry) bool { n++; return false }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Range did not stop: called %d times", n)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src, err := filecache.Open(t.TempDir(), filecache.WithCompression(filecache.Zstd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[filecache.ActionID]string)
+	for i, s := range []string{"first", "second", strings.Repeat("third ", 1000), "first"} {
+		id := filecache.NewActionID([]byte(fmt.Sprintf("export-%d", i)))
+		if _, _, err = src.Put(id, strings.NewReader(s)); err != nil {
+			t.Fatal(err)
+		}
+		want[id] = s
+	}
+	var buf strings.Builder
+	if err = src.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.String()
+
+	dst, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dst.Import(strings.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	for id, s := range want {
+		if b, _, err := dst.GetBytes(id); err != nil {
+			t.Errorf("%x: %+v", id, err)
+		} else if string(b) != s {
+			t.Errorf("%x: got %q, wanted %q", id, b, s)
+		}
+	}
+
+	// A data file tampered with is skipped.
+	bad, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bad.Import(strings.NewReader(strings.Replace(archive, "second", "SECOND", 1))); err != nil {
+		t.Fatal(err)
+	}
+	for id, s := range want {
+		_, _, err := bad.GetBytes(id)
+		if s == "second" {
+			if !errors.Is(err, filecache.ErrNotFound) {
+				t.Errorf("tampered %x: got %+v, wanted ErrNotFound", id, err)
+			}
+		} else if err != nil {
+			t.Errorf("%x: %+v", id, err)
+		}
+	}
+}
+
+func TestExportImportExpiry(t *testing.T) {
+	now := time.Now()
+	src, err := filecache.Open(t.TempDir(), filecache.WithNow(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl := filecache.NewActionID([]byte("export-ttl"))
+	permanent := filecache.NewActionID([]byte("export-permanent"))
+	if _, _, err = src.PutWithExpiry(ttl, strings.NewReader("short lived"), now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = src.Put(permanent, strings.NewReader("long lived")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = src.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := filecache.Open(t.TempDir(), filecache.WithNow(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dst.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []filecache.ActionID{ttl, permanent} {
+		if _, _, err = dst.GetBytes(id); err != nil {
+			t.Fatalf("%x before expiry: %+v", id, err)
+		}
+	}
+	now = now.Add(2 * time.Minute)
+	if _, _, err = dst.GetBytes(ttl); !errors.Is(err, filecache.ErrNotFound) {
+		t.Errorf("after expiry: got %+v, wanted ErrNotFound", err)
+	}
+	if _, _, err = dst.GetBytes(permanent); err != nil {
+		t.Errorf("permanent entry after the expiry of the other: %+v", err)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	now := time.Now().Add(time.Hour).Truncate(time.Second)
+	c, err := filecache.Open(t.TempDir(),
+		filecache.WithNow(func() time.Time { return now }),
+		filecache.WithTouchOnGet(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := filecache.NewActionID([]byte("touch"))
+	if err = c.Touch(id); !errors.Is(err, filecache.ErrNotFound) {
+		t.Errorf("Touch before Put: got %+v, wanted ErrNotFound", err)
+	}
+	if _, _, err = c.Put(id, strings.NewReader("touched")); err != nil {
+		t.Fatal(err)
+	}
+	fn, _, err := c.GetFile(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := now.Add(-24 * time.Hour)
+	if err = os.Chtimes(fn, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Touch(id); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(fn); err != nil {
+		t.Fatal(err)
+	} else if !fi.ModTime().Equal(now) {
+		t.Errorf("Touch: got mtime %v, wanted %v", fi.ModTime(), now)
+	}
+
+	if err = os.Chtimes(fn, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.GetFile(id); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(fn); err != nil {
+		t.Fatal(err)
+	} else if !fi.ModTime().Equal(now) {
+		t.Errorf("GetFile: got mtime %v, wanted %v", fi.ModTime(), now)
+	}
+
+	expiredID := filecache.NewActionID([]byte("touch expired"))
+	if _, _, err = c.PutWithExpiry(expiredID, strings.NewReader("expired"), now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Touch(expiredID); !errors.Is(err, filecache.ErrNotFound) {
+		t.Errorf("Touch after expiry: got %+v, wanted ErrNotFound", err)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Now().Truncate(time.Second)
+	now := base
+	c, err := filecache.Open(dir,
+		filecache.WithNow(func() time.Time { return now }),
+		filecache.WithMaxAge(time.Hour),
+		filecache.WithTrimLimit(24*time.Hour),
+		filecache.WithTrimInterval(time.Minute),
+		filecache.WithTrimSize(1000),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Puts trim before storing, so this is the last trim before the checks.
+	now = base.Add(-10 * time.Minute)
+	put := func(name string, size int, age time.Duration) filecache.ActionID {
+		id := filecache.NewActionID([]byte(name))
+		entry, err := c.PutBytes(id, []byte(strings.Repeat(name[:1], size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime := base.Add(-age)
+		// The max age is measured from the Put.
+		setPutTime(t, c, id, mtime)
+		for _, fn := range []string{
+			filepath.Join(dir, fmt.Sprintf("%02x", id[0]), fmt.Sprintf("%x-a", id)),
+			filepath.Join(dir, fmt.Sprintf("%02x", entry[0]), fmt.Sprintf("%x-d", entry)),
+		} {
+			if err := os.Chtimes(fn, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return id
+	}
+	old := put("old", 10, 2*time.Hour)
+	young := put("young", 10, 20*time.Minute)
+	large := put("large", 2000, 0)
+
+	// The size based trim removes only the data file, so Has is not enough.
+	has := func(id filecache.ActionID) bool {
+		_, _, err := c.GetBytes(id)
+		if err != nil && !errors.Is(err, filecache.ErrNotFound) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	// The large file is still in its grace period (trim interval).
+	now = base.Add(30 * time.Second)
+	if err = c.Trim(); err != nil {
+		t.Fatal(err)
+	}
+	if has(old) {
+		t.Error("entry older than max age survived")
+	}
+	if !has(young) || !has(large) {
+		t.Errorf("young: %t large: %t, wanted both", has(young), has(large))
+	}
+
+	// Past the trim interval, the large file is removed for its size only.
+	now = base.Add(2 * time.Minute)
+	if err = c.Trim(); err != nil {
+		t.Fatal(err)
+	}
+	if has(large) {
+		t.Error("large entry survived the size based trim")
+	}
+	if !has(young) {
+		t.Error("young entry has been removed")
+	}
+}
+
+// setPutTime rewrites the time of the Put recorded in the action entry of id.
+func setPutTime(t *testing.T, c *filecache.Cache, id filecache.ActionID, tm time.Time) {
+	t.Helper()
+	fn := c.ActionFile(id)
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The entry ends with the time (%20d) and a newline.
+	b = append(b[:len(b)-21], fmt.Sprintf("%20d\n", tm.UnixNano())...)
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(fn, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(fn, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxAgeAndTrimLimit(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Now().Truncate(time.Second)
+	now := base
+	c, err := filecache.Open(dir,
+		filecache.WithNow(func() time.Time { return now }),
+		filecache.WithMaxAge(48*time.Hour),
+		filecache.WithTrimLimit(24*time.Hour),
+		filecache.WithTrimInterval(time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// put stores the entry as Put putAge before base, and last used usedAge before base.
+	put := func(name string, putAge, usedAge time.Duration) filecache.ActionID {
+		id := filecache.NewActionID([]byte(name))
+		out, err := c.PutBytes(id, []byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		setPutTime(t, c, id, base.Add(-putAge))
+		used := base.Add(-usedAge)
+		for _, fn := range []string{c.ActionFile(id), c.OutputFile(out)} {
+			if err := os.Chtimes(fn, used, used); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return id
+	}
+	// The Puts trim before storing, so they must not be the last trim.
+	now = base.Add(-10 * time.Minute)
+	// Only the max age removes it: it has been used recently.
+	aged := put("aged", 72*time.Hour, time.Hour)
+	// Only the trim limit removes it: it is younger than the max age.
+	unused := put("unused", 30*time.Hour, 30*time.Hour)
+	kept := put("kept", 30*time.Hour, time.Hour)
+
+	now = base
+	if err = c.Trim(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		id   filecache.ActionID
+		want bool
+	}{{"aged", aged, false}, {"unused", unused, false}, {"kept", kept, true}} {
+		if ok, err := c.Has(tc.id); err != nil || ok != tc.want {
+			t.Errorf("%s: got %t, %+v, wanted %t", tc.name, ok, err, tc.want)
+		}
+	}
+}
+
+func TestTrimTemp(t *testing.T) {
+	dir, otherDir := t.TempDir(), t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	create := func(fn string) string {
+		t.Helper()
+		if err := os.WriteFile(fn, []byte("left behind"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, old, old); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	for _, tc := range []struct {
+		name    string
+		tempDir string
+		removed bool
+	}{
+		{"default", "", true},
+		{"WithTempDir", otherDir, false},
+	} {
+		c, err := filecache.Open(dir, filecache.WithTempDir(tc.tempDir),
+			filecache.WithTrimInterval(0), filecache.WithTrimLimit(24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stale := create(filepath.Join(c.TempDir(), "filecache-stale.out"))
+		fresh := filepath.Join(c.TempDir(), "filecache-fresh.out")
+		if err = os.WriteFile(fresh, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.Trim(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(stale); tc.removed != errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: stale temp file: %+v, wanted removed=%t", tc.name, err, tc.removed)
+		}
+		if _, err = os.Stat(fresh); err != nil {
+			t.Errorf("%s: fresh temp file: %+v", tc.name, err)
+		}
+	}
+}
+
+func TestIncrementalTrim(t *testing.T) {
+	dir := t.TempDir()
+	c, err := filecache.Open(dir,
+		filecache.WithTrimInterval(0),
+		filecache.WithIncrementalTrim(64),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * filecache.DefaultTrimLimit)
+	for i := 0; i < 256; i++ {
+		fn := filepath.Join(dir, fmt.Sprintf("%02x", i), fmt.Sprintf("%064x-d", i))
+		if err := os.WriteFile(fn, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 4; i++ {
+		res, err := c.TrimResult()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RemovedFiles != 64 {
+			t.Errorf("%d. trim removed %d files, wanted 64", i, res.RemovedFiles)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, "trim.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fields := strings.Fields(string(b)); len(fields) != 2 || fields[1] != fmt.Sprintf("%d", (i*64)%256) {
+			t.Errorf("%d. trim.txt: %q", i, b)
+		}
+	}
+	if st, err := c.Stats(); err != nil {
+		t.Fatal(err)
+	} else if st.Count != 0 {
+		t.Errorf("%d data files remained", st.Count)
+	}
+}
+
+func TestPutReader(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			dir := t.TempDir()
+			var codec filecache.Codec
+			if compress {
+				codec = filecache.Zstd
+			}
+			c, err := filecache.Open(dir, filecache.WithCompression(codec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			id := filecache.NewActionID([]byte("putreader"))
+			want := strings.Repeat("streamed ", 1000)
+			// Hide the Seek method of strings.Reader.
+			if _, n, err := c.PutReader(id, io.MultiReader(strings.NewReader(want))); err != nil {
+				t.Fatal(err)
+			} else if n != int64(len(want)) {
+				t.Errorf("PutReader: got size %d, wanted %d", n, len(want))
+			}
+			if b, _, err := c.GetBytes(id); err != nil {
+				t.Fatal(err)
+			} else if string(b) != want {
+				t.Errorf("got %q, wanted %q", b, want)
+			}
+			if tmps, _ := filepath.Glob(filepath.Join(dir, ".put-*")); len(tmps) != 0 {
+				t.Errorf("temporary files left: %q", tmps)
+			}
+		})
+	}
+}
+
+// cancelReader cancels the context once more than after bytes have been read through it.
+type cancelReader struct {
+	io.ReadSeeker
+	cancel context.CancelFunc
+	after  int
+	read   int
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	if r.read += n; r.read > r.after {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestPutContext(t *testing.T) {
+	data := bytes.Repeat([]byte("cancelled "), 1<<14)
+	out := func() filecache.OutputID {
+		h := filecache.NewHash()
+		h.Write(data)
+		return h.SumOutputID()
+	}()
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			var codec filecache.Codec
+			if compress {
+				codec = filecache.Zstd
+			}
+			c, err := filecache.Open(t.TempDir(), filecache.WithCompression(codec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tc := range []struct {
+				name  string
+				after int
+			}{
+				{"before", -1},
+				// Past the hashing pass, in the middle of the copy.
+				{"copy", len(data) + len(data)/2},
+			} {
+				ctx, cancel := context.WithCancel(context.Background())
+				if tc.after < 0 {
+					cancel()
+				}
+				id := filecache.NewActionID([]byte("putcontext-" + tc.name))
+				r := &cancelReader{ReadSeeker: bytes.NewReader(data), cancel: cancel, after: tc.after}
+				if _, _, err = c.PutContext(ctx, id, r); !errors.Is(err, context.Canceled) {
+					t.Errorf("%s: got %+v, wanted %v", tc.name, err, context.Canceled)
+				}
+				cancel()
+				if ok, err := c.Has(id); err != nil || ok {
+					t.Errorf("%s: Has: %t, %+v", tc.name, ok, err)
+				}
+				if _, err = os.Stat(c.OutputFile(out)); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("%s: data file left behind: %+v", tc.name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetFileContext(t *testing.T) {
+	data := bytes.Repeat([]byte("fetched "), 1<<14)
+	var calls atomic.Int32
+	var cancelFetch context.CancelFunc
+	c, err := filecache.Open(t.TempDir(),
+		filecache.WithSource(func(ctx context.Context, id filecache.ActionID) (io.ReadCloser, error) {
+			calls.Add(1)
+			return io.NopCloser(&cancelReader{ReadSeeker: bytes.NewReader(data), cancel: cancelFetch, after: len(data) / 2}), nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := filecache.NewActionID([]byte("getfilecontext"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err = c.GetFileContext(ctx, id); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled: got %+v, wanted %v", err, context.Canceled)
+	}
+
+	ctx, cancelFetch = context.WithCancel(context.Background())
+	defer cancelFetch()
+	if _, _, err = c.GetFileContext(ctx, id); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled mid-fetch: got %+v, wanted %v", err, context.Canceled)
+	}
+	if calls.Load() == 0 {
+		t.Error("the source has not been called")
+	}
+	if ok, err := c.Has(id); err != nil || ok {
+		t.Errorf("Has after the aborted fetch: %t, %+v", ok, err)
+	}
+}
+
+func TestNewActionIDWith(t *testing.T) {
+	p := []byte("key")
+	if got, want := filecache.NewActionIDWith(sha256.New, p), filecache.NewActionID(p); got != want {
+		t.Errorf("sha256: got %x, wanted %x", got, want)
+	}
+	// Longer digests are truncated.
+	sum512 := sha512.Sum512(p)
+	if got := filecache.NewActionIDWith(sha512.New, p); !bytes.Equal(got[:], sum512[:len(got)]) {
+		t.Errorf("sha512: got %x, wanted %x", got, sum512[:len(got)])
+	}
+	// Shorter ones are zero padded.
+	var want filecache.ActionID
+	binary.BigEndian.PutUint32(want[:], crc32.ChecksumIEEE(p))
+	if got := filecache.NewActionIDWith(func() hash.Hash { return crc32.NewIEEE() }, p); got != want {
+		t.Errorf("crc32: got %x, wanted %x", got, want)
+	}
+}
+
+func TestActionHasher(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(fn, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ah := filecache.NewActionHasher()
+	ah.AddString("a\x00")
+	ah.AddBytes([]byte("b\x00"))
+	if err := ah.AddFile(fn); err != nil {
+		t.Fatal(err)
+	}
+	if err := ah.AddReader(strings.NewReader("stdin")); err != nil {
+		t.Fatal(err)
+	}
+
+	contentID, stdinID := filecache.SumID([]byte("content")), filecache.SumID([]byte("stdin"))
+	want := filecache.NewActionID(append(append([]byte("a\x00b\x00"), contentID[:]...), stdinID[:]...))
+	if got := ah.ActionID(); got != want {
+		t.Errorf("got %x, wanted %x", got, want)
+	}
+}
+
+func TestHashSumOutputID(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h := filecache.NewHash()
+	h.Write([]byte("data"))
+	out, err := c.PutBytes(h.SumActionID(), []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.SumOutputID(); got != out {
+		t.Errorf("got %x, wanted the OutputID %x", got, out)
+	}
+}
+
+func TestHashReader(t *testing.T) {
+	hr := filecache.NewHashReader(strings.NewReader("data"))
+	b, err := io.ReadAll(hr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "data" {
+		t.Errorf("read %q", b)
+	}
+	if got, want := hr.SumID(), filecache.SumID(b); got != want {
+		t.Errorf("got %x, wanted %x", got, want)
+	}
+}
+
+// BenchmarkConcurrentPut runs 10k small PutReaders concurrently, per op.
+func BenchmarkConcurrentPut(b *testing.B) {
+	c, err := filecache.Open(b.TempDir(), filecache.WithTrimInterval(time.Hour))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	const concurrency = 10_000
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < concurrency; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				key := fmt.Sprintf("%d-%d", i, j)
+				if _, _, err := c.PutReader(filecache.NewActionID([]byte(key)), strings.NewReader(key)); err != nil {
+					b.Error(err)
+				}
+			}(j)
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cachegrpc serves a filecache.Cache over gRPC, as an alternative to its HTTP Handler.
+//
+// Get and Put stream the content, so large outputs are not buffered in memory.
+package cachegrpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative cache.proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/UNO-SOFT/filecache"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// chunkSize is the size of the data in a GetResponse.
+const chunkSize = 64 << 10
+
+type server struct {
+	UnimplementedCacheServer
+	c *filecache.Cache
+}
+
+// NewServer returns the CacheServer of the cache, to be registered with RegisterCacheServer.
+func NewServer(c *filecache.Cache) CacheServer { return server{c: c} }
+
+func (s server) Get(req *GetRequest, stream Cache_GetServer) error {
+	id, err := decodeActionID(req.GetActionId())
+	if err != nil {
+		return err
+	}
+	rc, entry, err := s.c.GetReader(id)
+	if err != nil {
+		return statusError(err)
+	}
+	defer rc.Close()
+	first := &GetResponse{Size: entry.Size, OutputId: entry.OutputID[:]}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(rc, buf)
+		if n != 0 || first != nil {
+			resp := first
+			if resp == nil {
+				resp = &GetResponse{}
+			}
+			first = nil
+			resp.Data = buf[:n]
+			if sendErr := stream.Send(resp); sendErr != nil {
+				return sendErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+}
+
+func (s server) Put(stream Cache_PutServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		if err == io.EOF {
+			return status.Error(codes.InvalidArgument, "no action ID")
+		}
+		return err
+	}
+	id, err := decodeActionID(req.GetActionId())
+	if err != nil {
+		return err
+	}
+	pr := &putReader{stream: stream, data: req.GetData()}
+	// Refuse empty content before storing anything, as the HTTP Handler does.
+	if err := pr.fill(); err != nil {
+		if err == io.EOF {
+			return status.Error(codes.InvalidArgument, "empty content")
+		}
+		return err
+	}
+	out, size, err := s.c.PutReader(id, pr)
+	if err != nil {
+		return statusError(err)
+	}
+	return stream.SendAndClose(&PutResponse{OutputId: out[:], Size: size})
+}
+
+func (s server) Has(ctx context.Context, req *HasRequest) (*HasResponse, error) {
+	id, err := decodeActionID(req.GetActionId())
+	if err != nil {
+		return nil, err
+	}
+	ok, err := s.c.Has(id)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &HasResponse{Found: ok}, nil
+}
+
+func (s server) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	id, err := decodeActionID(req.GetActionId())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.c.Delete(id); err != nil {
+		return nil, statusError(err)
+	}
+	return &DeleteResponse{}, nil
+}
+
+// putReader reads the data of the PutRequests of the stream.
+type putReader struct {
+	stream Cache_PutServer
+	data   []byte
+}
+
+func (pr *putReader) Read(p []byte) (int, error) {
+	if err := pr.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, pr.data)
+	pr.data = pr.data[n:]
+	return n, nil
+}
+
+// fill receives the PutRequests till one with data.
+func (pr *putReader) fill() error {
+	for len(pr.data) == 0 {
+		req, err := pr.stream.Recv()
+		if err != nil {
+			return err
+		}
+		pr.data = req.GetData()
+	}
+	return nil
+}
+
+// decodeActionID decodes the base64 (URL encoding) ActionID, returning InvalidArgument on error.
+func decodeActionID(actionIDb64 string) (filecache.ActionID, error) {
+	id, err := filecache.DecodeActionID(actionIDb64)
+	if err != nil {
+		return id, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return id, nil
+}
+
+// statusError translates the errors of the cache to gRPC status errors.
+func statusError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, filecache.ErrNotFound) || errors.Is(err, filecache.ErrCorrupt):
+		code = codes.NotFound
+	case errors.Is(err, filecache.ErrNoSpace):
+		code = codes.ResourceExhausted
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	default:
+		if st, ok := status.FromError(err); ok {
+			return st.Err()
+		}
+	}
+	return status.Error(code, fmt.Sprint(err))
+}
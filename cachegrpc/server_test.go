@@ -0,0 +1,122 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cachegrpc_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/UNO-SOFT/filecache"
+	"github.com/UNO-SOFT/filecache/cachegrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestServer(t *testing.T) {
+	c, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ln := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	cachegrpc.RegisterCacheServer(srv, cachegrpc.NewServer(c))
+	go srv.Serve(ln)
+	defer srv.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := cachegrpc.NewCacheClient(conn)
+	ctx := context.Background()
+
+	id := filecache.NewActionID([]byte("grpc"))
+	idb64 := base64.URLEncoding.EncodeToString(id[:])
+	if _, err := client.Has(ctx, &cachegrpc.HasRequest{ActionId: "x"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("bad ActionID: got %v", err)
+	}
+	if resp, err := client.Has(ctx, &cachegrpc.HasRequest{ActionId: idb64}); err != nil || resp.GetFound() {
+		t.Errorf("Has before Put: got %v, %v", resp, err)
+	}
+
+	// Empty content is refused, even in several (empty) messages.
+	put, err := client.Put(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range []*cachegrpc.PutRequest{{ActionId: idb64}, {}} {
+		if err := put.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := put.CloseAndRecv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("empty Put: got %v, wanted InvalidArgument", err)
+	}
+	if resp, err := client.Has(ctx, &cachegrpc.HasRequest{ActionId: idb64}); err != nil || resp.GetFound() {
+		t.Errorf("Has after empty Put: got %v, %v", resp, err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 30000)
+	put, err = client.Put(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, first := 0, true; i < len(data); i, first = i+100000, false {
+		req := &cachegrpc.PutRequest{Data: data[i:min(i+100000, len(data))]}
+		if first {
+			req.ActionId = idb64
+		}
+		if err := put.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putResp, err := put.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := filecache.SumID(data); putResp.GetSize() != int64(len(data)) || !bytes.Equal(putResp.GetOutputId(), out[:]) {
+		t.Errorf("Put: got %d %x, wanted %d %x", putResp.GetSize(), putResp.GetOutputId(), len(data), out)
+	}
+
+	get, err := client.Get(ctx, &cachegrpc.GetRequest{ActionId: idb64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for {
+		resp, err := get.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, resp.GetData()...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Get: got %d bytes, wanted %d", len(got), len(data))
+	}
+
+	if _, err := client.Delete(ctx, &cachegrpc.DeleteRequest{ActionId: idb64}); err != nil {
+		t.Fatal(err)
+	}
+	get, err = client.Get(ctx, &cachegrpc.GetRequest{ActionId: idb64})
+	if err == nil {
+		_, err = get.Recv()
+	}
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Get after Delete: got %v", err)
+	}
+}
@@ -6,20 +6,31 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -28,6 +39,7 @@ import (
 	"github.com/google/renameio/v2"
 	"github.com/peterbourgon/ff/v4"
 	"github.com/peterbourgon/ff/v4/ffhelp"
+	gocache "github.com/rogpeppe/go-internal/cache"
 	"github.com/tgulacsi/go/httpunix"
 	"github.com/tgulacsi/go/version"
 )
@@ -38,14 +50,46 @@ var logger = zlog.NewLogger(zlog.MaybeConsoleHandler(&verbose, os.Stderr)).SLog(
 func main() {
 	if err := Main(); err != nil {
 		logger.Error("Main", "error", err)
-		os.Exit(1)
+		// Exit with the exit code of the executed command, if it failed.
+		code := 1
+		var ec interface{ ExitCode() int }
+		if errors.As(err, &ec) && ec.ExitCode() > 0 {
+			code = ec.ExitCode()
+		}
+		os.Exit(code)
 	}
 }
 
 func Main() error {
 	var cache *filecache.Cache
+	var flagCacheDir *string
 
+	// The flags of serve, set by serveFS.
+	var tlsCert, tlsKey, clientCA, authToken, upstreamAddr, corsOrigin string
+	// The flags for connecting to the server (or upstream).
+	var clientOpts clientOptions
+	var up *upstream
+	var metricsAuth, bazel bool
+	var shutdownTimeout time.Duration
+	var maxUploadSize uint64
 	serveCmd := ff.Command{Name: "serve",
+		Usage: "serve [FLAGS] <address to listen on>",
+		LongHelp: `Serves the cache over HTTP.
+
+With --tls-cert and --tls-key, it serves HTTPS (on TCP addresses only:
+the TLS flags are ignored for unix sockets), and with --client-ca,
+it requires client certificates signed by that CA (mTLS).
+
+POST /_trim trims the cache right away, and responds with the result as JSON.
+With --auth-token, it requires the token, as storing and deleting do.
+
+With --bazel, it serves the Bazel remote HTTP cache protocol, too:
+GET and PUT /ac/<hex SHA-256> (action results) and /cas/<hex SHA-256> (content).
+
+With --cors-origin, browsers (a web UI) on that origin may GET and HEAD the entries.
+
+Started by systemd socket activation (LISTEN_FDS and LISTEN_PID are set),
+it serves on the inherited socket, and the address is not needed.`,
 		Exec: func(ctx context.Context, args []string) error {
 			var verboseLevelSet bool
 			for _, a := range os.Args[1:] {
@@ -57,154 +101,533 @@ func Main() error {
 			if !verboseLevelSet {
 				verbose++
 			}
-			if len(args) == 0 {
+			ln, err := systemdListener()
+			if err != nil {
+				return fmt.Errorf("socket activation: %w", err)
+			}
+			var addr string
+			if ln != nil {
+				logger.Info("socket activation", "network", ln.Addr().Network(), "addr", ln.Addr().String())
+			} else if len(args) == 0 {
 				return errors.New("address to listen on is required")
+			} else {
+				addr = strings.TrimPrefix(prepareAddr(args[0]), "http://")
+				logger.Info("address", "arg", args[0], "addr", addr)
 			}
-			addr := strings.TrimPrefix(prepareAddr(args[0]), "http://")
-			logger.Info("address", "arg", args[0], "addr", addr)
 
-			http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-				actionIDb64 := strings.TrimPrefix(r.URL.Path, "/")
-				logger := logger.With("actionID", actionIDb64)
-				b, err := base64.URLEncoding.DecodeString(actionIDb64)
-				logger.Debug("handle", "method", r.Method, "path", r.URL.Path, "decoded", len(b), "error", err)
-				if err != nil {
-					logger.Error("decode", "error", err)
-					http.Error(w, fmt.Sprintf("decode %q: %+v", actionIDb64, err), http.StatusBadRequest)
-					return
+			maxUpload := filecache.WithMaxUploadSize(int64(min(maxUploadSize, math.MaxInt64)))
+			withBazel := filecache.WithBazel(bazel)
+			hndl := cache.Handler(maxUpload, withBazel)
+			if up != nil {
+				hndl = cache.Handler(
+					maxUpload, withBazel,
+					filecache.WithFetchOnMiss(func(ctx context.Context, actionID filecache.ActionID) error {
+						return up.fetch(ctx, cache, actionID)
+					}),
+					filecache.WithPutCallback(func(actionID filecache.ActionID) { up.push(cache, actionID) }),
+				)
+			}
+			if authToken != "" {
+				public := []string{"/_healthz"}
+				if !metricsAuth {
+					public = append(public, "/_metrics")
 				}
-				var actionID filecache.ActionID
-				if len(b) != cap(actionID) {
-					logger.Error("hashsize", "len", len(b), "error", err)
-					http.Error(w, fmt.Sprintf("size mismatch: got %q (%d) wanted %d", actionIDb64, len(b), cap(actionID)), http.StatusBadRequest)
-					return
+				hndl = requireToken(authToken, hndl, public...)
+			}
+			if corsOrigin != "" {
+				// Outside requireToken: the preflight requests have no Authorization header.
+				hndl = allowCORS(corsOrigin, hndl)
+			}
+			if ln == nil {
+				if ln, err = listen(addr); err != nil {
+					return err
 				}
-				copy(actionID[:], b)
-
-				switch r.Method {
-				default:
-					http.Error(w, fmt.Sprintf("%q: only GET and POST allowed", r.Method), http.StatusMethodNotAllowed)
-					return
-
-				case "GET":
-					fn, _, err := cache.GetFile(actionID)
-					logger.Debug("server GET", "fn", fn, "error", err)
-					if fn == "" {
-						logger.Info("not found")
-						http.Error(w, err.Error(), http.StatusNotFound)
-						return
-					} else if err != nil {
-						logger.Error("GetFile", "error", err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-					fh, err := os.Open(fn)
-					if err != nil {
-						logger.Error("open", "file", fn, "error", err)
-						code := http.StatusInternalServerError
-						if errors.Is(err, fs.ErrNotExist) {
-							code = http.StatusNotFound
-						}
-						http.Error(w, err.Error(), code)
-						return
-					}
-					defer fh.Close()
-					fi, err := fh.Stat()
-					if err != nil {
-						logger.Error("stat", "file", fh.Name(), "error", err)
-						http.Error(w, err.Error(), http.StatusNotFound)
-						return
-					}
-					logger.Info("serve", "file", fn, "length", fi.Size())
-					if fi.Size() == 0 {
-						http.Error(w, "zero sized file", http.StatusNotFound)
-						return
-					}
-					w.Header().Set("Content-Type", "application/octet-stream")
-					w.Header().Set("Content-Length", fmt.Sprintf("%d", fi.Size()))
-					_, err = io.Copy(w, fh)
-					if err != nil {
-						logger.Error("serving from cached", "file", fh.Name(), "error", err)
-					}
-					return
-
-				case "POST":
-					fh, err := os.CreateTemp("", actionIDb64+"-*")
-					if err != nil {
-						logger.Error("create temp", "error", err)
-						http.Error(w, fmt.Sprintf("create temp: %+v", err), http.StatusInternalServerError)
-						return
-					}
-					defer func() {
-						_ = fh.Close()
-						_ = os.Remove(fh.Name())
-					}()
-					_ = os.Remove(fh.Name())
-					logger.Info("store", "actionID", actionIDb64)
-					var n int64
-					if n, err = io.Copy(fh, r.Body); err != nil {
-						logger.Error("write file", "error", err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					} else if n == 0 {
-						logger.Error("zero-sized file")
-						http.Error(w, "zero-sized file", http.StatusPreconditionFailed)
-						return
-					}
-
-					_, _ = fh.Seek(0, 0)
-					logger.Info("put", "file", fh.Name())
-					if _, n, err = cache.Put(actionID, fh); err != nil {
-						logger.Error("Put", "error", err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					} else if n == 0 {
-						logger.Error("Put", "length", n)
-						http.Error(w, "zero length", http.StatusInternalServerError)
-						return
+			}
+			defer ln.Close()
+			srv := &http.Server{
+				Handler:           hndl,
+				ReadHeaderTimeout: 15 * time.Second,
+				IdleTimeout:       5 * time.Minute,
+			}
+			if tlsCert != "" || tlsKey != "" {
+				if ln.Addr().Network() == "unix" {
+					logger.Warn("TLS is ignored on unix sockets", "addr", ln.Addr().String())
+				} else {
+					if srv.TLSConfig, err = serverTLSConfig(clientCA); err != nil {
+						return err
 					}
-					w.WriteHeader(201)
+					logger.Debug("listening with TLS", "on", ln.Addr().String())
+					return serveOn(ctx, srv, ln, tlsCert, tlsKey, shutdownTimeout)
 				}
-			})
-
-			logger.Debug("listening", "on", addr)
-			return httpunix.ListenAndServe(ctx, addr, http.DefaultServeMux)
+			}
+			logger.Debug("listening", "on", ln.Addr().String())
+			return serveOn(ctx, srv, ln, "", "", shutdownTimeout)
 		},
 	}
 
 	FS := ff.NewFlagSet("filecache")
-	flagCacheDir := FS.String('d', "cache-dir", "", "cache directory")
+	flagCacheDir = FS.String('d', "cache-dir", "", "cache directory")
 	var err error
 	if *flagCacheDir, err = os.UserCacheDir(); err == nil {
 		*flagCacheDir = filepath.Join(*flagCacheDir, "filecache")
 	}
 	flagStdin := FS.Bool('S', "stdin", "read and pass stdin")
 	flagTrim := FS.Bool('T', "trim", "trim before run")
+	flagEnv := FS.StringListLong("env", "include this environment variable in the cache key (repeatable)")
+	flagInputFiles := FS.StringListLong("input-file", "include the hash of the content of this file in the cache key (repeatable)")
+	flagEnvAll := FS.BoolLong("env-all", "include the whole environment in the cache key")
+	flagStderr := FS.BoolLong("stderr", "cache the stderr, too, and replay it on a hit")
+	flagNoCache := FS.BoolLong("no-cache", "run the command without looking it up in the cache, and store the result only locally (no POST to the server)")
+	flagRefresh := FS.BoolLong("refresh", "run the command without looking it up in the cache, and store the result as usual")
+	flagDryRun := FS.BoolLong("dry-run", "print the ActionID and whether it is a hit (locally or on a server), without running or storing anything")
+	flagTimeout := FS.DurationLong("timeout", 0, "kill the command if it runs longer than this")
+	flagTTL := FS.DurationLong("ttl", 0, "the stored result expires after this (it is stored only locally then, not POSTed to the server)")
+	flagCacheFailures := FS.BoolLong("cache-failures", "cache the output of the command even if it exits with non-zero")
 	flagTrimInterval := FS.DurationLong("trim-interval", 1*time.Hour, "trim interval")
 	flagTrimLimit := FS.DurationLong("trim-limit", 5*24*time.Hour, "trim limit")
 	flagTrimSize := FS.Uint64Long("trim-size", 1<<30, "trim file size limit")
+	flagVerify := FS.BoolLong("verify", "verify the checksum of cached files on read")
+	flagTempDir := FS.StringLong("temp-dir", "", "directory for the temporary files of the uploads and the memoized runs (default: the tmp subdirectory of the cache directory)")
+	flagCompress := FS.StringEnumLong("compress", "compress cached files", "", "gzip", "zstd")
 	FS.Value('v', "verbose", &verbose, "verbose logging")
-	flagServer := FS.StringLong("server", "", "server to connect to")
+	flagServer := FS.StringListLong("server", "server to connect to (repeatable, or comma separated: tried in order)")
+	FS.UintVar(&clientOpts.retries, 0, "server-retries", 0, "retry the requests to the servers this many times on connection errors and 5xx answers")
+	FS.DurationVar(&clientOpts.retryBackoff, 0, "server-retry-backoff", 100*time.Millisecond, "wait this long before the first retry, doubled for each next one")
+	FS.BoolVar(&clientOpts.shard, 0, "shard", "spread the entries over the --servers: each ActionID is tried on its own server (chosen by rendezvous hashing) first")
+	FS.StringVar(&clientOpts.serverCA, 0, "server-ca", "", "CA certificate (PEM) to trust for an https:// server")
+	FS.StringVar(&clientOpts.clientCert, 0, "client-cert", "", "client certificate (PEM) for an https:// server requiring mTLS")
+	FS.StringVar(&clientOpts.clientKey, 0, "client-key", "", "client key (PEM) for --client-cert")
+	FS.StringVar(&clientOpts.token, 0, "server-token", "", "token to authenticate to the server with (default: $FILECACHE_TOKEN)")
 	flagStdout := FS.String('o', "out", "", "output to this file")
 	flagVersion := FS.BoolLong("version", "print version")
 
+	serveFS := ff.NewFlagSet("serve").SetParent(FS)
+	serveFS.StringVar(&tlsCert, 0, "tls-cert", "", "TLS certificate (PEM) to serve HTTPS with")
+	serveFS.StringVar(&tlsKey, 0, "tls-key", "", "TLS key (PEM) for --tls-cert")
+	serveFS.StringVar(&clientCA, 0, "client-ca", "", "CA certificate (PEM) to require and verify client certificates with")
+	serveFS.StringVar(&authToken, 0, "auth-token", "", "require this bearer token from the clients")
+	serveFS.BoolVar(&metricsAuth, 0, "metrics-auth", "require the --auth-token for /_metrics, too")
+	serveFS.BoolVar(&bazel, 0, "bazel", "serve the Bazel remote HTTP cache protocol (/ac/ and /cas/), too")
+	serveFS.StringVar(&corsOrigin, 0, "cors-origin", "", "allow the browsers to GET the entries from this origin (or * for any)")
+	serveFS.StringVar(&upstreamAddr, 0, "upstream", "", "upstream server to mirror the stores to, and to fetch the misses from")
+	serveFS.Uint64Var(&maxUploadSize, 0, "max-upload-size", 0, "refuse the uploads larger than this many bytes (default: the --trim-size)")
+	serveFS.DurationVar(&shutdownTimeout, 0, "shutdown-timeout", 30*time.Second, "on SIGTERM, wait this long for the requests in flight (the uploads) to finish")
+	serveCmd.Flags = serveFS
+
+	getFS := ff.NewFlagSet("get").SetParent(FS)
+	flagKeyFile := getFS.StringLong("key-file", "", "read the raw (32 bytes) ActionID from this file")
+	getCmd := ff.Command{Name: "get", Flags: getFS,
+		Usage: "get [FLAGS] <base64 ActionID>",
+		LongHelp: `Writes the cached output of the ActionID to the stdout (or --out).
+
+The ActionID is looked up in the local cache, then on the --server.
+Exits with non-zero if it is not found.`,
+		Exec: func(ctx context.Context, args []string) error {
+			var actionID filecache.ActionID
+			switch {
+			case *flagKeyFile != "":
+				b, err := os.ReadFile(*flagKeyFile)
+				if err != nil {
+					return err
+				}
+				if len(b) != len(actionID) {
+					return fmt.Errorf("%q: size mismatch: got %d wanted %d", *flagKeyFile, len(b), len(actionID))
+				}
+				copy(actionID[:], b)
+			case len(args) == 1:
+				if actionID, err = filecache.DecodeActionID(args[0]); err != nil {
+					return err
+				}
+			default:
+				return errors.New("the base64 ActionID or --key-file is required")
+			}
+			actionIDb64 := base64.URLEncoding.EncodeToString(actionID[:])
+
+			var outFh *renameio.PendingFile
+			destW := io.Writer(os.Stdout)
+			if *flagStdout != "" && *flagStdout != "-" {
+				if outFh, err = renameio.NewPendingFile(*flagStdout, renameio.WithPermissions(0644)); err != nil {
+					return err
+				}
+				defer outFh.Cleanup()
+				destW = outFh
+			}
+
+			rc, _, err := cache.GetReader(actionID)
+			if err == nil {
+				defer rc.Close()
+				if _, err = io.Copy(destW, rc); err == nil && outFh != nil {
+					err = outFh.CloseAtomicallyReplace()
+				}
+				return err
+			}
+			if !errors.Is(err, filecache.ErrNotFound) {
+				logger.Warn("get from cache", "actionID", actionIDb64, "error", err)
+			}
+
+			srvs, err := newServers(*flagServer, clientOpts)
+			if err != nil {
+				return err
+			}
+			if len(srvs.list) != 0 {
+				if found, err := srvs.fetch(ctx, actionID, destW); found {
+					if err == nil && outFh != nil {
+						err = outFh.CloseAtomicallyReplace()
+					}
+					return err
+				}
+				return fmt.Errorf("%s: %w in the cache, nor on the servers", actionIDb64, filecache.ErrNotFound)
+			}
+			return fmt.Errorf("%s: %w in the cache", actionIDb64, filecache.ErrNotFound)
+		},
+	}
+
+	putFS := ff.NewFlagSet("put").SetParent(FS)
+	flagKey := putFS.StringLong("key", "", "use the ActionID of this string (hashed with NewActionID), instead of a base64 ActionID")
+	putCmd := ff.Command{Name: "put", Flags: putFS,
+		Usage: "put [FLAGS] [<base64 ActionID>] [<file>]",
+		LongHelp: `Stores the file (or the stdin, if it is missing or "-") in the local cache,
+under the base64 ActionID (or the one of --key), and POSTs it to the --server, too.
+
+Empty input is rejected.`,
+		Exec: func(ctx context.Context, args []string) error {
+			var actionID filecache.ActionID
+			if *flagKey != "" {
+				actionID = filecache.NewActionID([]byte(*flagKey))
+			} else if len(args) == 0 {
+				return errors.New("the base64 ActionID or --key is required")
+			} else {
+				if actionID, err = filecache.DecodeActionID(args[0]); err != nil {
+					return err
+				}
+				args = args[1:]
+			}
+			if len(args) > 1 {
+				return fmt.Errorf("at most one file is allowed, got %q", args)
+			}
+			actionIDb64 := base64.URLEncoding.EncodeToString(actionID[:])
+
+			r := io.Reader(os.Stdin)
+			if len(args) == 1 && args[0] != "-" {
+				fh, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer fh.Close()
+				r = fh
+			}
+			br := bufio.NewReader(r)
+			if _, err := br.Peek(1); err != nil {
+				if errors.Is(err, io.EOF) {
+					return errors.New("empty input")
+				}
+				return err
+			}
+			out, size, err := cache.PutReader(actionID, br)
+			if err != nil {
+				return err
+			}
+			logger.Info("put", "actionID", actionIDb64, "outputID", fmt.Sprintf("%x", out), "size", size)
+
+			srvs, err := newServers(*flagServer, clientOpts)
+			if err != nil || len(srvs.list) == 0 {
+				return err
+			}
+			fn, _, err := cache.GetFile(actionID)
+			if err != nil {
+				return err
+			}
+			fh, err := os.Open(fn)
+			if err != nil {
+				return err
+			}
+			defer fh.Close()
+			return srvs.post(ctx, actionID, fh, size)
+		},
+	}
+
+	listFS := ff.NewFlagSet("list").SetParent(FS)
+	flagJSON := listFS.BoolLong("json", "print the entries as JSON objects, one per line")
+	flagSort := listFS.StringEnumLong("sort", "sort the entries by size (largest first) or age (oldest first)", "", "size", "age")
+	listCmd := ff.Command{Name: "list", Flags: listFS,
+		Usage: "list [FLAGS]",
+		LongHelp: `Lists the entries of the local cache (--cache-dir): one line per entry,
+with the base64 ActionID, the size and the time of the entry.`,
+		Exec: func(ctx context.Context, args []string) error {
+			type listEntry struct {
+				ActionID string    `json:"actionID"`
+				OutputID string    `json:"outputID"`
+				Size     int64     `json:"size"`
+				Time     time.Time `json:"time"`
+			}
+			var entries []listEntry
+			if err := cache.Range(func(id filecache.ActionID, entry gocache.Entry) bool {
+				entries = append(entries, listEntry{
+					ActionID: base64.URLEncoding.EncodeToString(id[:]),
+					OutputID: fmt.Sprintf("%x", entry.OutputID),
+					Size:     entry.Size, Time: entry.Time,
+				})
+				return ctx.Err() == nil
+			}); err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			switch *flagSort {
+			case "size":
+				slices.SortStableFunc(entries, func(a, b listEntry) int { return cmp.Compare(b.Size, a.Size) })
+			case "age":
+				slices.SortStableFunc(entries, func(a, b listEntry) int { return a.Time.Compare(b.Time) })
+			}
+
+			bw := bufio.NewWriter(os.Stdout)
+			enc := json.NewEncoder(bw)
+			for _, e := range entries {
+				if *flagJSON {
+					if err := enc.Encode(e); err != nil {
+						return err
+					}
+				} else {
+					fmt.Fprintf(bw, "%s %d %s\n", e.ActionID, e.Size, e.Time.Format(time.RFC3339))
+				}
+			}
+			return bw.Flush()
+		},
+	}
+
+	statsFS := ff.NewFlagSet("stats").SetParent(FS)
+	flagWatch := statsFS.DurationLong("watch", 0, "print the stats again at this interval, till interrupted")
+	statsCmd := ff.Command{Name: "stats", Flags: statsFS,
+		Usage: "stats [FLAGS]",
+		LongHelp: `Prints the number and the total size of the data files of the local cache
+(--cache-dir), on disk and of their content (differing with compression or encryption),
+and the modification time of the oldest and newest one.`,
+		Exec: func(ctx context.Context, args []string) error {
+			for {
+				st, err := cache.Stats()
+				if err != nil {
+					return err
+				}
+				fmt.Printf("entries: %d\nsize: %d\nlogical size: %d\noldest: %s\nnewest: %s\n",
+					st.Count, st.PhysicalSize, st.LogicalSize, st.Oldest.Format(time.RFC3339), st.Newest.Format(time.RFC3339))
+				if *flagWatch <= 0 {
+					return nil
+				}
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(*flagWatch):
+					fmt.Println()
+				}
+			}
+		},
+	}
+
+	pruneFS := ff.NewFlagSet("prune").SetParent(FS)
+	flagOlderThan := pruneFS.DurationLong("older-than", 0, "remove the entries older than this")
+	flagLargerThan := pruneFS.Uint64Long("larger-than", 0, "remove the entries larger than this many bytes")
+	flagPruneKeys := pruneFS.StringListLong("key", "remove only the entry of this base64 ActionID (repeatable)")
+	pruneCmd := ff.Command{Name: "prune", Flags: pruneFS,
+		Usage: "prune [FLAGS]",
+		LongHelp: `Removes the entries of the local cache (--cache-dir) matching all the given criteria
+immediately, regardless of --trim-interval, and prints how much has been reclaimed
+on disk. A data file shared with entries not removed is kept.
+
+At least one of --older-than, --larger-than and --key is required.`,
+		Exec: func(ctx context.Context, args []string) error {
+			if *flagOlderThan <= 0 && *flagLargerThan <= 0 && len(*flagPruneKeys) == 0 {
+				return errors.New("at least one of --older-than, --larger-than and --key is required")
+			}
+			var keys map[filecache.ActionID]struct{}
+			if len(*flagPruneKeys) != 0 {
+				keys = make(map[filecache.ActionID]struct{}, len(*flagPruneKeys))
+				for _, k := range *flagPruneKeys {
+					actionID, err := filecache.DecodeActionID(k)
+					if err != nil {
+						return err
+					}
+					keys[actionID] = struct{}{}
+				}
+			}
+			cutoff := time.Now().Add(-*flagOlderThan)
+
+			var ids []filecache.ActionID
+			outs := make(map[filecache.ActionID]filecache.OutputID)
+			// The data files may be shared: a data file is removed
+			// only with the last of the action entries referencing it.
+			refs := make(map[filecache.OutputID]int)
+			if err := cache.Range(func(id filecache.ActionID, entry gocache.Entry) bool {
+				refs[entry.OutputID]++
+				if keys != nil {
+					if _, ok := keys[id]; !ok {
+						return true
+					}
+				}
+				if (*flagOlderThan > 0 && !entry.Time.Before(cutoff)) ||
+					(*flagLargerThan > 0 && uint64(entry.Size) <= *flagLargerThan) {
+					return true
+				}
+				ids = append(ids, id)
+				outs[id] = entry.OutputID
+				return ctx.Err() == nil
+			}); err != nil {
+				return err
+			}
+			var reclaimed int64
+			for _, id := range ids {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				out := outs[id]
+				refs[out]--
+				var err error
+				if refs[out] > 0 {
+					err = cache.DeleteEntry(id)
+				} else {
+					// Count what is freed on disk, with compression or encryption.
+					if fi, statErr := os.Stat(cache.OutputFile(out)); statErr == nil {
+						reclaimed += fi.Size()
+					}
+					err = cache.Delete(id)
+				}
+				if err != nil {
+					return fmt.Errorf("delete %s: %w", base64.URLEncoding.EncodeToString(id[:]), err)
+				}
+			}
+			fmt.Printf("pruned %d entries, reclaimed %d bytes\n", len(ids), reclaimed)
+			return nil
+		},
+	}
+
+	verifyFS := ff.NewFlagSet("verify").SetParent(FS)
+	flagRepair := verifyFS.BoolLong("repair", "remove the corrupt and orphan files")
+	verifyCmd := ff.Command{Name: "verify", Flags: verifyFS,
+		Usage: "verify [FLAGS]",
+		LongHelp: `Re-hashes each data file of the local cache (--cache-dir), and compares it to its OutputID,
+and looks for the orphans (data files without an action entry, and vice versa).
+
+Prints the problems found, and a summary. With --repair, the problems are removed,
+otherwise it exits with non-zero if there are any.`,
+		Exec: func(ctx context.Context, args []string) error {
+			res, err := cache.Verify(*flagRepair)
+			if err != nil {
+				return err
+			}
+			for _, p := range res.Problems {
+				var removed string
+				if p.Removed {
+					removed = " (removed)"
+				}
+				fmt.Printf("%s %s: %v%s\n", p.Kind, p.Path, p.Err, removed)
+			}
+			fmt.Printf("scanned: %d\nok: %d\ncorrupt: %d\norphan: %d\n", res.Scanned, res.OK, res.Corrupt, res.Orphan)
+			if len(res.Problems) != 0 && !*flagRepair {
+				return fmt.Errorf("%d problems found (see --repair)", len(res.Problems))
+			}
+			return nil
+		},
+	}
+
+	warmFS := ff.NewFlagSet("warm").SetParent(FS)
+	warmCmd := ff.Command{Name: "warm", Flags: warmFS,
+		Usage: "warm [FLAGS] [<base64 ActionID>...]",
+		LongHelp: `Ensures that the entries of the ActionIDs (or of the lines of the stdin, if there are none)
+are present in the local cache (--cache-dir), fetching the missing ones from the --server.
+
+Prints the status of each ActionID (present, fetched, missing or failed),
+and exits with non-zero if any of them is missing or failed.`,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				scanner := bufio.NewScanner(os.Stdin)
+				for scanner.Scan() {
+					if line := strings.TrimSpace(scanner.Text()); line != "" {
+						args = append(args, line)
+					}
+				}
+				if err := scanner.Err(); err != nil {
+					return err
+				}
+			}
+			ids := make([]filecache.ActionID, len(args))
+			for i, arg := range args {
+				if ids[i], err = filecache.DecodeActionID(arg); err != nil {
+					return err
+				}
+			}
+			srvs, err := newServers(*flagServer, clientOpts)
+			if err != nil {
+				return err
+			}
+			var source filecache.Fetcher
+			if len(srvs.list) != 0 {
+				source = srvs.fetcher(cache.TempDir())
+			}
+			results, err := cache.Warm(ctx, ids, source)
+			var notFound int
+			for i, res := range results {
+				if res.Err != nil {
+					fmt.Printf("%s %s: %v\n", args[i], res.Status, res.Err)
+				} else {
+					fmt.Printf("%s %s\n", args[i], res.Status)
+				}
+				if res.Status == filecache.WarmMissing {
+					notFound++
+				}
+			}
+			if err == nil && notFound != 0 {
+				err = fmt.Errorf("%d of %d: %w", notFound, len(ids), filecache.ErrNotFound)
+			}
+			return err
+		},
+	}
+
 	app := ff.Command{Name: "cmd", Flags: FS,
 		Usage:       "command to execute",
-		Subcommands: []*ff.Command{&serveCmd},
+		Subcommands: []*ff.Command{&serveCmd, &getCmd, &putCmd, &listCmd, &statsCmd, &pruneCmd, &verifyCmd, &warmCmd},
 		Exec: func(ctx context.Context, args []string) error {
-			var cmdBuf bytes.Buffer
+			ah := filecache.NewActionHasher()
 			// Number of arguments, \0
 			// arguments, separated by \0
-			// (optionally), the hash of the stdin's content.
-			fmt.Fprintf(&cmdBuf, "%d\x00", len(args))
+			// "env\0", number of the selected environment variables, \0
+			// the selected environment variables as KEY=VALUE, separated by \0
+			// "inputs\0", number of the input files, \0
+			// the hashes of the input files' content, in order,
+			// (optionally), "stdin\0", the hash of the stdin's content.
+			// The tags and the counts of the sections keep them apart:
+			// an input file's hash does not collide with the stdin's.
+			fmt.Fprintf(ah, "%d\x00", len(args))
 			for _, arg := range args {
-				_, _ = cmdBuf.WriteString(arg)
-				_ = cmdBuf.WriteByte(0)
+				ah.AddString(arg + "\x00")
+			}
+			var env []string
+			if *flagEnvAll {
+				env = os.Environ()
+			} else {
+				for _, k := range *flagEnv {
+					if v, ok := os.LookupEnv(k); ok {
+						env = append(env, k+"="+v)
+					} else {
+						// Unset differs from the empty value.
+						env = append(env, k)
+					}
+				}
+			}
+			slices.Sort(env)
+			env = slices.Compact(env)
+			fmt.Fprintf(ah, "env\x00%d\x00", len(env))
+			for _, kv := range env {
+				ah.AddString(kv + "\x00")
+			}
+			fmt.Fprintf(ah, "inputs\x00%d\x00", len(*flagInputFiles))
+			for _, fn := range *flagInputFiles {
+				if err := ah.AddFile(fn); err != nil {
+					return fmt.Errorf("hash %q: %w", fn, err)
+				}
 			}
 
 			var stdin io.Reader
 			if *flagStdin {
-				hsh := filecache.NewHash()
 				fh, err := os.CreateTemp("", "filecache-*.inp")
 				if err != nil {
 					return err
@@ -213,7 +636,8 @@ func Main() error {
 					_ = fh.Close()
 					_ = os.Remove(fh.Name())
 				}()
-				if _, err = io.Copy(io.MultiWriter(hsh, fh), os.Stdin); err != nil {
+				hr := filecache.NewHashReader(os.Stdin)
+				if _, err = io.Copy(fh, hr); err != nil {
 					return fmt.Errorf("copy stdin to temp file %q: %w", fh.Name(), err)
 				}
 				if _, err = fh.Seek(0, 0); err != nil {
@@ -221,9 +645,10 @@ func Main() error {
 				}
 				stdin = fh
 				_ = os.Remove(fh.Name())
-				sumID := hsh.SumID()
-				_, _ = cmdBuf.Write(sumID[:])
-				logger.Debug("stdin", "hash", hsh.SumID())
+				sumID := hr.SumID()
+				ah.AddString("stdin\x00")
+				ah.AddBytes(sumID[:])
+				logger.Debug("stdin", "hash", sumID)
 			}
 
 			var outFh *renameio.PendingFile
@@ -236,9 +661,90 @@ func Main() error {
 				destW = outFh
 			}
 
-			actionID := filecache.NewActionID(cmdBuf.Bytes())
-			cacheFn, _, err := cache.GetFile(actionID)
-			logger.Debug("action", "id", actionID, "fn", cacheFn, "error", err)
+			actionID := ah.ActionID()
+			// The stderr (with --stderr) is stored as the output of a derived action.
+			stderrID := filecache.NewActionID(append(actionID[:], "stderr"...))
+			// The non-zero exit code (with --cache-failures) is stored similarly.
+			exitID := filecache.NewActionID(append(actionID[:], "exit"...))
+
+			srvs, err := newServers(*flagServer, clientOpts)
+			if err != nil {
+				return err
+			}
+
+			if *flagDryRun {
+				actionIDb64 := base64.URLEncoding.EncodeToString(actionID[:])
+				fmt.Println("actionID:", actionIDb64)
+				if ok, err := cache.Has(actionID); err != nil {
+					return err
+				} else if ok {
+					fmt.Println("HIT local")
+					return nil
+				}
+				for _, s := range srvs.forID(actionID) {
+					if serverHas(ctx, s.client, s.url+"/"+actionIDb64) {
+						fmt.Println("HIT server", s.url)
+						return nil
+					}
+				}
+				fmt.Println("MISS")
+				return nil
+			}
+
+			// replayStderr copies the stored stderr of the action (with --stderr) to os.Stderr.
+			// A missing stderr (of a run without --stderr) is empty.
+			replayStderr := func() error {
+				if !*flagStderr {
+					return nil
+				}
+				if fn, _, err := cache.GetFileContext(ctx, stderrID); err == nil {
+					fh, err := os.Open(fn)
+					if err != nil {
+						return err
+					}
+					defer fh.Close()
+					_, err = io.Copy(os.Stderr, fh)
+					return err
+				}
+				if len(srvs.list) == 0 {
+					return nil
+				}
+				_, err := srvs.fetch(ctx, stderrID, os.Stderr)
+				return err
+			}
+
+			// replay replays the stderr and the exit code of the action, after the stdout.
+			replay := func() error {
+				if err := replayStderr(); err != nil {
+					return err
+				}
+				b, _, err := cache.GetBytes(exitID)
+				if err != nil && len(srvs.list) != 0 {
+					var buf bytes.Buffer
+					if found, _ := srvs.fetch(ctx, exitID, &buf); found {
+						b = buf.Bytes()
+					}
+				}
+				if len(b) == 0 {
+					return nil
+				}
+				code, err := strconv.Atoi(string(b))
+				if err != nil {
+					return fmt.Errorf("parse cached exit code %q: %w", b, err)
+				} else if code == 0 {
+					// Overwritten by a successful run.
+					return nil
+				}
+				return fmt.Errorf("%q (cached): %w", args, exitCode(code))
+			}
+
+			// Both --no-cache and --refresh skip the lookups (local and server).
+			lookup := !*flagNoCache && !*flagRefresh
+			var cacheFn string
+			if lookup {
+				cacheFn, _, err = cache.GetFileContext(ctx, actionID)
+				logger.Debug("action", "id", actionID, "fn", cacheFn, "error", err)
+			}
 			if cacheFn != "" && err == nil {
 				fh, err := os.Open(cacheFn)
 				if err != nil {
@@ -249,52 +755,23 @@ func Main() error {
 					}
 					if err != nil {
 						logger.Error("serving from cached", "file", fh.Name(), "error", err)
+						return err
 					}
-					return err
+					return replay()
 				}
 			}
 
-			var actionIDb64 string
-			client := http.DefaultClient
 			// Try to get from the server
-			logger.Debug("get from server?", "server", *flagServer)
-			if *flagServer != "" {
-				oldAddr := *flagServer
-				*flagServer = prepareAddr(*flagServer)
-				logger.Debug("try", "server", *flagServer, "original", oldAddr)
-				actionIDb64 = base64.URLEncoding.EncodeToString(actionID[:])
-				if strings.HasPrefix(*flagServer, httpunix.Scheme+"://") {
-					tr := &httpunix.Transport{
-						DialTimeout:           1 * time.Second,
-						RequestTimeout:        5 * time.Second,
-						ResponseHeaderTimeout: 5 * time.Second,
-					}
-					old := *flagServer
-					*flagServer = httpunix.Scheme + "://" + tr.GetLocation(strings.TrimPrefix(*flagServer, httpunix.Scheme+"://"))
-					logger.Debug("httpunix", "old", old, "new", *flagServer)
-					client = &http.Client{Transport: tr}
-				}
-				req, err := http.NewRequestWithContext(ctx, "GET", *flagServer+"/"+actionIDb64, nil)
-				if err != nil {
-					logger.Error("create request to", "server", *flagServer, "error", err)
-				} else if resp, err := client.Do(req); err != nil {
-					logger.Warn("connect", "to", req.URL.String(), "transport", client.Transport, "server", *flagServer, "original", oldAddr, "error", err)
-				} else if resp.StatusCode >= 300 {
-					lvl := slog.LevelError
-					if resp.StatusCode == http.StatusNotFound {
-						lvl = slog.LevelInfo
-					}
-					logger.Log(ctx, lvl, resp.Status, "connectTo", req.URL.String())
-					if resp.Body != nil {
-						resp.Body.Close()
-					}
-				} else {
-					logger.Debug("server found", "url", req.URL.String())
-					if _, err = io.Copy(destW, resp.Body); err == nil && outFh != nil {
+			logger.Debug("get from server?", "servers", len(srvs.list), "lookup", lookup)
+			if lookup && len(srvs.list) != 0 {
+				if found, err := srvs.fetch(ctx, actionID, destW); found {
+					if err == nil && outFh != nil {
 						err = outFh.CloseAtomicallyReplace()
 					}
-					_ = resp.Body.Close()
-					return err
+					if err != nil {
+						return err
+					}
+					return replay()
 				}
 			}
 
@@ -307,7 +784,9 @@ func Main() error {
 				}
 			}
 
-			fh, err := os.CreateTemp("", "filecache-*.out")
+			// Create the temp files in the temp dir of the cache (by default on the same file system),
+			// so PutFile can hardlink them, and trim removes them if left behind.
+			fh, err := os.CreateTemp(cache.TempDir(), "filecache-*.out")
 			if err != nil {
 				return err
 			}
@@ -315,13 +794,33 @@ func Main() error {
 				_ = fh.Close()
 				_ = os.Remove(fh.Name())
 			}()
+			var errFh *os.File
+			if *flagStderr {
+				if errFh, err = os.CreateTemp(cache.TempDir(), "filecache-*.err"); err != nil {
+					return err
+				}
+				defer func() {
+					_ = errFh.Close()
+					_ = os.Remove(errFh.Name())
+				}()
+			}
 
+			// The timer starts only now, after the lookups.
+			runCtx := ctx
+			if *flagTimeout > 0 {
+				var cancel context.CancelFunc
+				runCtx, cancel = context.WithTimeout(ctx, *flagTimeout)
+				defer cancel()
+			}
 			// nosemgrep: go.lang.security.audit.dangerous-exec-command.dangerous-exec-command
-			cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+			cmd := exec.CommandContext(runCtx, args[0], args[1:]...)
 			if stdin != nil {
 				cmd.Stdin = stdin
 			}
 			cmd.Stderr = os.Stderr
+			if errFh != nil {
+				cmd.Stderr = io.MultiWriter(os.Stderr, errFh)
+			}
 			cmd.Stdout = io.MultiWriter(fh, destW)
 			if outFh != nil {
 				cmd.Stdout = io.MultiWriter(cmd.Stdout, outFh)
@@ -329,11 +828,21 @@ func Main() error {
 			if cacheFh != nil {
 				cmd.Stdout = io.MultiWriter(cmd.Stdout, cacheFh)
 			}
+			var code int
 			if err = cmd.Run(); err != nil {
-				logger.Error("executing", "args", args, "error", err)
-				return fmt.Errorf("%q: %w", args, err)
+				if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+					logger.Error("timed out", "args", args, "timeout", *flagTimeout)
+					return fmt.Errorf("%q: timed out after %s: %w", args, *flagTimeout, runCtx.Err())
+				}
+				var ee *exec.ExitError
+				if !*flagCacheFailures || !errors.As(err, &ee) || ee.ExitCode() <= 0 {
+					logger.Error("executing", "args", args, "error", err)
+					return fmt.Errorf("%q: %w", args, err)
+				}
+				code = ee.ExitCode()
+				logger.Info("caching failure", "args", args, "exitCode", code)
 			}
-			_ = os.Remove(fh.Name())
+			runErr := err
 			if outFh != nil {
 				if err = outFh.CloseAtomicallyReplace(); err != nil {
 					return err
@@ -343,45 +852,82 @@ func Main() error {
 				if err = cacheFh.CloseAtomicallyReplace(); err != nil {
 					return err
 				}
-				return nil
-			}
-			if *flagServer == "" {
-				return nil
 			}
 
-			if fi, err := fh.Stat(); err != nil {
+			// store puts the output of the action to a server, or, failing that, to the local cache.
+			// The empty outputs are stored in the local cache only, as the servers refuse them.
+			store := func(actionID filecache.ActionID, fh *os.File) error {
+				fi, err := fh.Stat()
+				if err != nil {
+					return err
+				}
+				if *flagTTL > 0 {
+					// The servers do not support expiry.
+					if _, err = fh.Seek(0, io.SeekStart); err != nil {
+						return fmt.Errorf("rewind %q: %w", fh.Name(), err)
+					}
+					_, _, err = cache.PutWithExpiry(actionID, fh, time.Now().Add(*flagTTL))
+					return err
+				}
+				if fi.Size() != 0 && len(srvs.list) != 0 && !*flagNoCache {
+					// Try to put to a server
+					if err = srvs.post(ctx, actionID, fh, fi.Size()); err == nil {
+						return nil
+					}
+					logger.Error("POST request", "error", err)
+				}
+				_, _, err = cache.PutFile(actionID, fh.Name())
 				return err
-			} else if fi.Size() == 0 {
-				logger.Warn("zero-sized", "file", fh.Name())
-				return nil
 			}
-			if _, err = fh.Seek(0, 0); err != nil {
-				return fmt.Errorf("rewind %q: %w", fh.Name(), err)
+			if cacheFh == nil {
+				if err = store(actionID, fh); err != nil {
+					return err
+				}
 			}
-
-			// Try to put to the server
-			logger.Debug("POST", "server", *flagServer, "actionID", actionIDb64)
-			if req, err := http.NewRequestWithContext(ctx, "POST", *flagServer+"/"+actionIDb64, fh); err != nil {
-				logger.Error("create POST request", "to", *flagServer, "error", err)
-			} else if resp, err := client.Do(req); err != nil {
-				logger.Error("POST request", "url", req.URL.String(), "server", *flagServer, "error", err)
-			} else {
-				if resp.Body != nil {
-					defer resp.Body.Close()
+			// Store the stderr even if it is empty, and clear the one of a previous run with --stderr,
+			// so a stale stderr is not replayed with this output.
+			if errFh == nil {
+				if ok, _ := cache.Has(stderrID); ok {
+					if errFh, err = os.CreateTemp(cache.TempDir(), "filecache-*.err"); err != nil {
+						return err
+					}
+					defer func() {
+						_ = errFh.Close()
+						_ = os.Remove(errFh.Name())
+					}()
 				}
-				logger.Debug("put cache", "status", resp.Status, "actionID", actionIDb64)
-				if resp.StatusCode >= 300 {
-					logger.Error("POST request", "url", req.URL.String(), "error", resp.Status)
-				} else {
+			}
+			if errFh != nil {
+				if err = store(stderrID, errFh); err != nil {
+					return err
+				}
+			}
+			// Overwrite the exit code of a previous failed run (see --refresh),
+			// so it is not replayed with this output.
+			// The exit code is not deleted, as its data file may be shared with other actions.
+			if code == 0 && !*flagCacheFailures {
+				if ok, _ := cache.Has(exitID); !ok {
 					return nil
 				}
 			}
-			if _, err = fh.Seek(0, 0); err != nil {
-				return fmt.Errorf("rewind after put %q: %w", fh.Name(), err)
+			codeFh, err := os.CreateTemp(cache.TempDir(), "filecache-*.exit")
+			if err != nil {
+				return err
 			}
-
-			_, _, err = cache.Put(actionID, fh)
-			return err
+			defer func() {
+				_ = codeFh.Close()
+				_ = os.Remove(codeFh.Name())
+			}()
+			if _, err = codeFh.WriteString(strconv.Itoa(code)); err != nil {
+				return err
+			}
+			if err = store(exitID, codeFh); err != nil {
+				return err
+			}
+			if code == 0 {
+				return nil
+			}
+			return fmt.Errorf("%q: %w", args, runErr)
 		},
 	}
 	if err := app.Parse(os.Args[1:]); err != nil {
@@ -397,26 +943,625 @@ func Main() error {
 	}
 	logger.Debug("parsed", "args", os.Args[1:])
 
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var autoTrimCtx context.Context
+	if app.GetSelected() == &serveCmd {
+		// A long running server should not depend on Puts to trim.
+		autoTrimCtx = ctx
+	}
+	var codec filecache.Codec
+	switch *flagCompress {
+	case "gzip":
+		codec = filecache.Gzip
+	case "zstd":
+		codec = filecache.Zstd
+	}
 	// nosemgrep: go.lang.correctness.permissions.file_permission.incorrect-default-permission
 	_ = os.MkdirAll(*flagCacheDir, 0750)
 	cache, err = filecache.Open(*flagCacheDir,
 		filecache.WithTrimInterval(*flagTrimInterval),
 		filecache.WithTrimLimit(*flagTrimLimit),
 		filecache.WithTrimSize(int64(*flagTrimSize)),
+		filecache.WithAutoTrim(autoTrimCtx),
+		filecache.WithVerifyOnGet(*flagVerify),
+		filecache.WithCompression(codec),
+		filecache.WithTempDir(*flagTempDir),
+		filecache.WithLogger(logger),
 	)
 	if err != nil {
 		return fmt.Errorf("open %q: %w", *flagCacheDir, err)
 	}
-	if *flagTrim {
-		if err := cache.Trim(); err != nil {
+	defer cache.Close()
+	if upstreamAddr != "" {
+		if up, err = newUpstream(upstreamAddr, clientOpts, cache.TempDir()); err != nil {
+			return fmt.Errorf("upstream %q: %w", upstreamAddr, err)
+		}
+	}
+	if *flagTrim && !*flagDryRun {
+		res, err := cache.TrimResult()
+		if err != nil {
 			return err
 		}
+		logger.Info("trim", "scanned", res.ScannedFiles, "removed", res.RemovedFiles, "removedBytes", res.RemovedBytes, "duration", res.Duration.String())
 	}
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer cancel()
 
 	return app.Run(ctx)
 }
+
+// fetchFromServer copies the output of the action from the server to dst, reporting whether it is found.
+// The errors before the body is received are logged, and reported as not found.
+func fetchFromServer(ctx context.Context, client *http.Client, server string, actionID filecache.ActionID, dst io.Writer) (bool, error) {
+	actionIDb64 := base64.URLEncoding.EncodeToString(actionID[:])
+	req, err := http.NewRequestWithContext(ctx, "GET", server+"/"+actionIDb64, nil)
+	if err != nil {
+		logger.Error("create request to", "server", server, "error", err)
+		return false, nil
+	}
+	// Setting it explicitly turns off the transparent gzip decoding of the transport.
+	req.Header.Set("Accept-Encoding", "zstd, gzip")
+	if !serverHas(ctx, client, req.URL.String()) {
+		logger.Info("not found on server", "url", req.URL.String())
+		return false, nil
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Warn("connect", "to", req.URL.String(), "transport", client.Transport, "server", server, "error", err)
+		return false, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		lvl := slog.LevelError
+		if resp.StatusCode == http.StatusNotFound {
+			lvl = slog.LevelInfo
+		}
+		logger.Log(ctx, lvl, resp.Status, "connectTo", req.URL.String())
+		return false, nil
+	}
+	logger.Debug("server found", "url", req.URL.String(), "encoding", resp.Header.Get("Content-Encoding"))
+	body, err := decodeBody(resp)
+	if err != nil {
+		return true, err
+	}
+	defer body.Close()
+	_, err = io.Copy(dst, body)
+	return true, err
+}
+
+// server is a cache server to connect to.
+type server struct {
+	client *http.Client
+	url    string
+}
+
+// servers are the cache servers to try, in order - or, if shard is set,
+// in the rendezvous hashing order of the ActionID (see forID).
+type servers struct {
+	list  []server
+	shard bool
+}
+
+// newServers returns the servers of the addresses,
+// each of which may be a comma separated list.
+func newServers(addrs []string, opts clientOptions) (servers, error) {
+	srvs := servers{shard: opts.shard}
+	for _, a := range addrs {
+		for _, addr := range strings.Split(a, ",") {
+			if addr = strings.TrimSpace(addr); addr == "" {
+				continue
+			}
+			client, url, err := newServerClient(addr, opts)
+			if err != nil {
+				return servers{}, fmt.Errorf("%q: %w", addr, err)
+			}
+			logger.Debug("server", "server", url, "original", addr)
+			srvs.list = append(srvs.list, server{client: client, url: url})
+		}
+	}
+	return srvs, nil
+}
+
+// forID returns the servers in the order to try for the action:
+// with shard, the server owning it (by rendezvous hashing of the URLs) first,
+// so each entry is stored on one server, and the others are only the fallbacks.
+func (ss servers) forID(actionID filecache.ActionID) []server {
+	if !ss.shard || len(ss.list) < 2 {
+		return ss.list
+	}
+	urls := make([]string, len(ss.list))
+	for i, s := range ss.list {
+		urls[i] = s.url
+	}
+	ordered := make([]server, 0, len(ss.list))
+	for _, i := range filecache.Rendezvous(actionID, urls) {
+		ordered = append(ordered, ss.list[i])
+	}
+	return ordered
+}
+
+// fetch copies the output of the action from the first server having it to dst,
+// reporting whether it is found.
+func (ss servers) fetch(ctx context.Context, actionID filecache.ActionID, dst io.Writer) (bool, error) {
+	for _, s := range ss.forID(actionID) {
+		if found, err := fetchFromServer(ctx, s.client, s.url, actionID, dst); found {
+			logger.Info("served", "server", s.url, "actionID", base64.URLEncoding.EncodeToString(actionID[:]), "error", err)
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// fetcher returns the Fetcher of the outputs from the servers,
+// downloading them into temp files in dir.
+func (ss servers) fetcher(dir string) filecache.Fetcher {
+	return func(ctx context.Context, actionID filecache.ActionID) (io.ReadCloser, error) {
+		fh, err := os.CreateTemp(dir, "fetch-*")
+		if err != nil {
+			return nil, err
+		}
+		_ = os.Remove(fh.Name())
+		found, err := ss.fetch(ctx, actionID, fh)
+		if err == nil && !found {
+			err = filecache.ErrNotFound
+		}
+		if err == nil {
+			_, err = fh.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		return fh, nil
+	}
+}
+
+// post POSTs the size bytes of body as the output of the action to the first server accepting it.
+func (ss servers) post(ctx context.Context, actionID filecache.ActionID, body io.ReadSeeker, size int64) error {
+	var errs []error
+	for _, s := range ss.forID(actionID) {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		// Hide the Close method of body, as the client closes it even on failure.
+		err := postToServer(ctx, s.client, s.url, actionID, struct{ io.ReadSeeker }{body}, size)
+		if err == nil {
+			logger.Info("stored", "server", s.url, "actionID", base64.URLEncoding.EncodeToString(actionID[:]))
+			return nil
+		}
+		logger.Warn("POST request", "server", s.url, "error", err)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// postToServer POSTs the size bytes of body as the output of the action to the server.
+func postToServer(ctx context.Context, client *http.Client, server string, actionID filecache.ActionID, body io.Reader, size int64) error {
+	actionIDb64 := base64.URLEncoding.EncodeToString(actionID[:])
+	logger.Debug("POST", "server", server, "actionID", actionIDb64)
+	req, err := http.NewRequestWithContext(ctx, "POST", server+"/"+actionIDb64, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if rs, ok := body.(io.ReadSeeker); ok {
+		// Let the retryTransport send it again.
+		req.GetBody = func() (io.ReadCloser, error) {
+			if _, err := rs.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return io.NopCloser(rs), nil
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	logger.Debug("put cache", "status", resp.Status, "actionID", actionIDb64)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", req.URL, resp.Status)
+	}
+	return nil
+}
+
+// exitCode is the error of a failed command replayed from the cache.
+type exitCode int
+
+func (e exitCode) Error() string { return "exit status " + strconv.Itoa(int(e)) }
+func (e exitCode) ExitCode() int { return int(e) }
+
+// requireToken returns a handler answering 401 Unauthorized to the requests
+// without the "Authorization: Bearer <token>" header, except for the public paths.
+func requireToken(token string, hndl http.Handler, public ...string) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(public, r.URL.Path) {
+			hndl.ServeHTTP(w, r)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		hndl.ServeHTTP(w, r)
+	})
+}
+
+// allowCORS returns a handler allowing the cross-origin GET and HEAD requests from origin
+// (which may be "*"): it adds the CORS headers, and answers the preflight (OPTIONS) requests.
+func allowCORS(origin string, hndl http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin != "*" {
+			w.Header().Add("Vary", "Origin")
+			if r.Header.Get("Origin") != origin {
+				hndl.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, If-None-Match, Range")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Content-Length, Content-Disposition")
+		hndl.ServeHTTP(w, r)
+	})
+}
+
+// retryTransport retries the requests failing with a connection error or a 5xx answer,
+// at most retries times, waiting backoff before the first retry, doubling it for each next one.
+//
+// The other answers (404 Not Found, the 4xx client errors) are returned as is,
+// and it does not wait beyond the deadline of the request's context.
+// A request with a body is only retried if it has GetBody.
+type retryTransport struct {
+	retries uint
+	backoff time.Duration
+	base    http.RoundTripper
+}
+
+func (rt retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := cmp.Or[http.RoundTripper](rt.base, http.DefaultTransport)
+	backoff := rt.backoff
+	for i := uint(0); ; i++ {
+		resp, err := base.RoundTrip(r)
+		if i == rt.retries || (err == nil && resp.StatusCode < 500) ||
+			r.Context().Err() != nil || (r.Body != nil && r.Body != http.NoBody && r.GetBody == nil) {
+			return resp, err
+		}
+		if deadline, ok := r.Context().Deadline(); ok && time.Until(deadline) < backoff {
+			return resp, err
+		}
+		status := "error"
+		if err == nil {
+			status = resp.Status
+			resp.Body.Close()
+		}
+		logger.Info("retry", "method", r.Method, "url", r.URL.String(), "status", status, "error", err, "backoff", backoff.String())
+		timer := time.NewTimer(backoff)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+		if r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = r.Clone(r.Context())
+			r.Body = body
+		}
+	}
+}
+
+// bearerTransport adds the "Authorization: Bearer <token>" header to the requests.
+type bearerTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (bt bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+bt.token)
+	if bt.base == nil {
+		return http.DefaultTransport.RoundTrip(r)
+	}
+	return bt.base.RoundTrip(r)
+}
+
+// clientOptions are the options for connecting to a server.
+type clientOptions struct {
+	serverCA, clientCert, clientKey, token string
+	// shard orders the servers by rendezvous hashing of the ActionID, see servers.forID.
+	shard bool
+	// retries and retryBackoff configure the retryTransport.
+	retries      uint
+	retryBackoff time.Duration
+}
+
+// newServerClient returns the client for the server at addr, and its base URL.
+func newServerClient(addr string, opts clientOptions) (*http.Client, string, error) {
+	client := http.DefaultClient
+	addr = prepareAddr(addr)
+	if strings.HasPrefix(addr, httpunix.Scheme+"://") {
+		tr := &httpunix.Transport{
+			DialTimeout:           1 * time.Second,
+			RequestTimeout:        5 * time.Second,
+			ResponseHeaderTimeout: 5 * time.Second,
+		}
+		old := addr
+		addr = httpunix.Scheme + "://" + tr.GetLocation(strings.TrimPrefix(addr, httpunix.Scheme+"://"))
+		logger.Debug("httpunix", "old", old, "new", addr)
+		client = &http.Client{Transport: tr}
+	} else if strings.HasPrefix(addr, "https://") && (opts.serverCA != "" || opts.clientCert != "") {
+		tlsConfig, err := clientTLSConfig(opts.serverCA, opts.clientCert, opts.clientKey)
+		if err != nil {
+			return nil, addr, err
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = tlsConfig
+		client = &http.Client{Transport: tr}
+	}
+	if token := cmp.Or(opts.token, os.Getenv("FILECACHE_TOKEN")); token != "" {
+		client = &http.Client{Transport: bearerTransport{token: token, base: client.Transport}}
+	}
+	if opts.retries != 0 {
+		client = &http.Client{Transport: retryTransport{retries: opts.retries, backoff: opts.retryBackoff, base: client.Transport}}
+	}
+	return client, addr, nil
+}
+
+// upstream is the server the serve subcommand mirrors the stores to,
+// and fetches the misses from.
+// Both are best effort: the errors are only logged.
+type upstream struct {
+	client *http.Client
+	url    string
+	dir    string
+}
+
+func newUpstream(addr string, opts clientOptions, dir string) (*upstream, error) {
+	client, url, err := newServerClient(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &upstream{client: client, url: url, dir: dir}, nil
+}
+
+// push POSTs the entry of the action ID to the upstream server.
+func (u *upstream) push(cache *filecache.Cache, actionID filecache.ActionID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	actionIDb64 := base64.URLEncoding.EncodeToString(actionID[:])
+	logger := logger.With("actionID", actionIDb64, "upstream", u.url)
+	rc, entry, err := cache.GetReader(actionID)
+	if err != nil {
+		logger.Warn("upstream push: GetReader", "error", err)
+		return
+	}
+	defer rc.Close()
+	req, err := http.NewRequestWithContext(ctx, "POST", u.url+"/"+actionIDb64, rc)
+	if err != nil {
+		logger.Warn("upstream push: create request", "error", err)
+		return
+	}
+	req.ContentLength = entry.Size
+	resp, err := u.client.Do(req)
+	if err != nil {
+		logger.Warn("upstream push", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Warn("upstream push", "status", resp.Status)
+		return
+	}
+	logger.Debug("upstream push", "status", resp.Status)
+}
+
+// fetch GETs the entry of the action ID from the upstream server, and puts it into the cache.
+func (u *upstream) fetch(ctx context.Context, cache *filecache.Cache, actionID filecache.ActionID) error {
+	actionIDb64 := base64.URLEncoding.EncodeToString(actionID[:])
+	req, err := http.NewRequestWithContext(ctx, "GET", u.url+"/"+actionIDb64, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", req.URL, resp.Status)
+	}
+	// Create the temp file in the temp dir (by default inside the cache dir), so PutFile can hardlink it.
+	fh, err := os.CreateTemp(u.dir, "upstream-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = fh.Close()
+		_ = os.Remove(fh.Name())
+	}()
+	if _, err = io.Copy(fh, resp.Body); err != nil {
+		return fmt.Errorf("GET %s: %w", req.URL, err)
+	}
+	if err = fh.Close(); err != nil {
+		return err
+	}
+	_, _, err = cache.PutFile(actionID, fh.Name())
+	logger.Info("fetched from upstream", "actionID", actionIDb64, "upstream", u.url, "error", err)
+	return err
+}
+
+// serverTLSConfig returns the TLS config of the server.
+// If clientCA is not empty, client certificates signed by it are required.
+func serverTLSConfig(clientCA string) (*tls.Config, error) {
+	tlsConfig := tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pool, err := loadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tlsConfig, nil
+}
+
+// listen listens on the TCP address, or on the unix socket of an http+unix:// address.
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, httpunix.Scheme+"://"); ok {
+		_ = os.Remove(path)
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serveOn serves srv on ln (with TLS iff certFile is not empty) till ctx is canceled.
+//
+// Then it stops accepting new requests, and waits at most shutdownTimeout
+// for the requests in flight to finish, so the uploads are either stored completely,
+// or aborted (and their temporary files removed) before it returns.
+func serveOn(ctx context.Context, srv *http.Server, ln net.Listener, certFile, keyFile string, shutdownTimeout time.Duration) error {
+	var inFlight sync.WaitGroup
+	var n atomic.Int64
+	hndl := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		n.Add(1)
+		defer func() { n.Add(-1); inFlight.Done() }()
+		hndl.ServeHTTP(w, r)
+	})
+	shutdownErr := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		pending := n.Load()
+		logger.Info("shutdown", "inFlight", pending, "timeout", shutdownTimeout.String())
+		shutCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := srv.Shutdown(shutCtx)
+		if err != nil {
+			// Closing the connections makes the remaining handlers fail fast.
+			_ = srv.Close()
+		}
+		aborted := n.Load()
+		inFlight.Wait()
+		logger.Info("shutdown", "drained", pending-aborted, "aborted", aborted, "error", err)
+		shutdownErr <- err
+	}()
+	var err error
+	if certFile != "" {
+		err = srv.ServeTLS(ln, certFile, keyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	if err = <-shutdownErr; err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	return nil
+}
+
+// systemdListener returns the listener passed by systemd socket activation
+// (see sd_listen_fds(3)), or nil if the process has not been started so.
+// Only the first passed socket is used.
+func systemdListener() (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// Do not pass them on to the child processes.
+	for _, k := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(k)
+	}
+	if n > 1 {
+		logger.Warn("socket activation: only the first socket is used", "LISTEN_FDS", n)
+	}
+	const listenFdsStart = 3
+	fh := os.NewFile(listenFdsStart, "LISTEN_FD_3")
+	defer fh.Close() // FileListener dups the descriptor
+	return net.FileListener(fh)
+}
+
+// clientTLSConfig returns the TLS config trusting the server CA (if given),
+// presenting the client certificate (if given).
+func clientTLSConfig(serverCA, certFile, keyFile string) (*tls.Config, error) {
+	var tlsConfig tls.Config
+	if serverCA != "" {
+		pool, err := loadCertPool(serverCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &tlsConfig, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", file)
+	}
+	return pool, nil
+}
+
+// decodeBody returns the body of the response, decoded according to its Content-Encoding.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	enc := resp.Header.Get("Content-Encoding")
+	if enc == "" || enc == "identity" {
+		return io.NopCloser(resp.Body), nil
+	}
+	for _, c := range []filecache.Codec{filecache.Zstd, filecache.Gzip} {
+		if c.Name() == enc {
+			return c.NewReader(resp.Body)
+		}
+	}
+	return nil, fmt.Errorf("unknown Content-Encoding %q", enc)
+}
+
+// serverHas asks the server with a HEAD request whether it has the entry at url.
+// Only a 404 Not Found answer means no: on any other error,
+// the GET request will tell.
+func serverHas(ctx context.Context, client *http.Client, url string) bool {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return true
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Debug("HEAD", "url", url, "error", err)
+		return true
+	}
+	resp.Body.Close()
+	logger.Debug("HEAD", "url", url, "status", resp.Status, "length", resp.ContentLength)
+	return resp.StatusCode != http.StatusNotFound
+}
+
 func prepareAddr(addr string) string {
 	if strings.HasPrefix(addr, "/") {
 		return httpunix.Scheme + "://" + addr
@@ -0,0 +1,453 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/UNO-SOFT/filecache"
+)
+
+func TestServeShutdown(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		shutdownTimeout time.Duration
+		finish          bool
+	}{
+		{"drained", 10 * time.Second, true},
+		{"aborted", 100 * time.Millisecond, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cache, err := filecache.Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cache.Close()
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+			defer cancel()
+
+			started := make(chan struct{})
+			var once sync.Once
+			hndl := cache.Handler()
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				once.Do(func() { close(started) })
+				hndl.ServeHTTP(w, r)
+			})}
+			served := make(chan error, 1)
+			go func() { served <- serveOn(ctx, srv, ln, "", "", tc.shutdownTimeout) }()
+
+			id := filecache.NewActionID([]byte("upload"))
+			data := bytes.Repeat([]byte("0123456789"), 1<<16)
+			pr, pw := io.Pipe()
+			uploaded := make(chan int, 1)
+			go func() {
+				resp, err := http.Post("http://"+ln.Addr().String()+"/"+base64.URLEncoding.EncodeToString(id[:]),
+					"application/octet-stream", pr)
+				if err != nil {
+					uploaded <- 0
+					return
+				}
+				resp.Body.Close()
+				uploaded <- resp.StatusCode
+			}()
+			if _, err := pw.Write(data[:len(data)/2]); err != nil {
+				t.Fatal(err)
+			}
+			<-started
+			if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+				t.Fatal(err)
+			}
+			<-ctx.Done()
+
+			if !tc.finish {
+				if err := <-served; err == nil {
+					t.Error("no error for the aborted shutdown")
+				}
+				pw.CloseWithError(io.ErrClosedPipe)
+				<-uploaded
+				if ok, err := cache.Has(id); err != nil || ok {
+					t.Errorf("aborted upload is in the cache: %t, %+v", ok, err)
+				}
+				if tmps, _ := filepath.Glob(filepath.Join(cache.TempDir(), ".put-*")); len(tmps) != 0 {
+					t.Errorf("temporary files left: %q", tmps)
+				}
+				return
+			}
+
+			select {
+			case err := <-served:
+				t.Fatalf("serve returned before the upload finished: %+v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+			if _, err := pw.Write(data[len(data)/2:]); err != nil {
+				t.Fatal(err)
+			}
+			pw.Close()
+			if code := <-uploaded; code != http.StatusCreated {
+				t.Errorf("upload: got %d", code)
+			}
+			if err := <-served; err != nil {
+				t.Error(err)
+			}
+			if got, _, err := cache.GetBytes(id); err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("got %q..., wanted %q...", got[:min(len(got), 20)], strings.Repeat("0123456789", 2))
+			}
+		})
+	}
+}
+
+func TestAllowCORS(t *testing.T) {
+	cache, err := filecache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	id := filecache.NewActionID([]byte("cors"))
+	if _, err := cache.PutBytes(id, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	hndl := allowCORS("https://ui.example.com", cache.Handler())
+	path := "/" + base64.URLEncoding.EncodeToString(id[:])
+
+	for _, tc := range []struct {
+		name, method, origin, allowed string
+		code                          int
+	}{
+		{"preflight", "OPTIONS", "https://ui.example.com", "https://ui.example.com", http.StatusNoContent},
+		{"get", "GET", "https://ui.example.com", "https://ui.example.com", http.StatusOK},
+		{"other origin", "GET", "https://evil.example.com", "", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, path, nil)
+			r.Header.Set("Origin", tc.origin)
+			if tc.method == "OPTIONS" {
+				r.Header.Set("Access-Control-Request-Method", "GET")
+			}
+			w := httptest.NewRecorder()
+			hndl.ServeHTTP(w, r)
+			if w.Code != tc.code {
+				t.Errorf("got %d, wanted %d", w.Code, tc.code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.allowed {
+				t.Errorf("Access-Control-Allow-Origin: got %q, wanted %q", got, tc.allowed)
+			}
+			if tc.method == "GET" && tc.allowed != "" && !strings.Contains(w.Header().Get("Access-Control-Expose-Headers"), "ETag") {
+				t.Errorf("ETag is not exposed: %q", w.Header())
+			}
+		})
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests++
+		n := requests
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case n%3 != 0:
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer srv.Close()
+	client, _, err := newServerClient(srv.URL, clientOptions{retries: 3, retryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := filecache.NewActionID([]byte("retry"))
+	if err := postToServer(context.Background(), client, srv.URL, id, strings.NewReader("body"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 || strings.Join(bodies, ",") != "body,body,body" {
+		t.Errorf("got %d requests with %q, wanted the body 3 times", requests, bodies)
+	}
+
+	requests, bodies = 0, nil
+	resp, err := client.Get(srv.URL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || requests != 1 {
+		t.Errorf("404: got %d after %d requests, wanted no retry", resp.StatusCode, requests)
+	}
+
+	// Not beyond the deadline of the context.
+	requests = 0
+	client, _, _ = newServerClient(srv.URL, clientOptions{retries: 3, retryBackoff: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := postToServer(ctx, client, srv.URL, id, strings.NewReader("body"), 4); err == nil {
+		t.Error("no error for 503")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond || requests != 1 {
+		t.Errorf("got %d requests in %s, wanted 1 without waiting", requests, d)
+	}
+}
+
+// runMain runs Main with the args, and returns its stdout and stderr.
+func runMain(t *testing.T, args ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	dir := t.TempDir()
+	outFh, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outFh.Close()
+	errFh, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer errFh.Close()
+	oldArgs, oldStdout, oldStderr := os.Args, os.Stdout, os.Stderr
+	os.Args, os.Stdout, os.Stderr = append([]string{"filecache"}, args...), outFh, errFh
+	err = Main()
+	os.Args, os.Stdout, os.Stderr = oldArgs, oldStdout, oldStderr
+	for _, x := range []struct {
+		s  *string
+		fh *os.File
+	}{{&stdout, outFh}, {&stderr, errFh}} {
+		b, readErr := os.ReadFile(x.fh.Name())
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		*x.s = string(b)
+	}
+	return stdout, stderr, err
+}
+
+// exitCodeOf returns the exit code Main's error would exit with, as main does.
+func exitCodeOf(err error) int {
+	var ec interface{ ExitCode() int }
+	if errors.As(err, &ec) {
+		return ec.ExitCode()
+	}
+	return 0
+}
+
+func TestCacheFailures(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+	runs := filepath.Join(dir, "runs")
+	countRuns := func() int {
+		b, _ := os.ReadFile(runs)
+		return len(b)
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		os.Remove(runs)
+		script := "printf x >>" + runs + "; exit 3"
+		for i := 0; i < 2; i++ {
+			out, _, err := runMain(t, "--cache-dir="+cacheDir, "--cache-failures", "--", "sh", "-c", script)
+			if out != "" || exitCodeOf(err) != 3 {
+				t.Errorf("%d. got %q, %+v, wanted exit 3", i, out, err)
+			}
+		}
+		if n := countRuns(); n != 1 {
+			t.Errorf("ran %d times, wanted once", n)
+		}
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		os.Remove(runs)
+		outFn, codeFn := filepath.Join(dir, "out"), filepath.Join(dir, "code")
+		script := "printf x >>" + runs + "; cat " + outFn + "; exit $(cat " + codeFn + ")"
+		run := func(refresh bool) (string, error) {
+			args := []string{"--cache-dir=" + cacheDir, "--cache-failures"}
+			if refresh {
+				args = append(args, "--refresh")
+			}
+			out, _, err := runMain(t, append(args, "--", "sh", "-c", script)...)
+			return out, err
+		}
+		for _, step := range []struct {
+			out, code string
+			refresh   bool
+		}{
+			{out: "failed", code: "3"},
+			{out: "ok", code: "0", refresh: true},
+			{out: "ok", code: "0"},
+		} {
+			if err := os.WriteFile(outFn, []byte(step.out), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(codeFn, []byte(step.code), 0644); err != nil {
+				t.Fatal(err)
+			}
+			out, err := run(step.refresh)
+			if want := step.code; out != step.out || strconv.Itoa(exitCodeOf(err)) != want {
+				t.Errorf("refresh=%t: got %q, %+v, wanted %q with exit %s", step.refresh, out, err, step.out, want)
+			}
+		}
+		if n := countRuns(); n != 2 {
+			t.Errorf("ran %d times, wanted twice", n)
+		}
+	})
+}
+
+func TestStderr(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+	runs, errFn := filepath.Join(dir, "runs"), filepath.Join(dir, "err")
+	// The command writes to the stderr only.
+	script := "printf x >>" + runs + "; cat " + errFn + " >&2"
+	// The refresh without --stderr clears the stored stderr.
+	for i, step := range []struct {
+		stderr            string
+		refresh, noStderr bool
+	}{
+		{stderr: "first"},
+		{stderr: "first"},
+		{stderr: "", refresh: true, noStderr: true},
+		{stderr: ""},
+	} {
+		if i == 0 || step.refresh {
+			if err := os.WriteFile(errFn, []byte(step.stderr), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		args := []string{"--cache-dir=" + cacheDir}
+		if !step.noStderr {
+			args = append(args, "--stderr")
+		}
+		if step.refresh {
+			args = append(args, "--refresh")
+		}
+		out, stderr, err := runMain(t, append(args, "--", "sh", "-c", script)...)
+		if err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		// The log lines go to the original stderr.
+		if out != "" || stderr != step.stderr {
+			t.Errorf("%d. got %q, %q, wanted only %q on the stderr", i, out, stderr, step.stderr)
+		}
+	}
+	if b, _ := os.ReadFile(runs); len(b) != 2 {
+		t.Errorf("ran %d times, wanted twice", len(b))
+	}
+}
+
+func TestActionIDSections(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for fn, content := range map[string]string{a: "a", b: "b"} {
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// actionID returns the ActionID printed by --dry-run, with the stdin read from stdinFn.
+	actionID := func(stdinFn string, args ...string) string {
+		t.Helper()
+		fh, err := os.Open(stdinFn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fh.Close()
+		oldStdin := os.Stdin
+		os.Stdin = fh
+		defer func() { os.Stdin = oldStdin }()
+		out, _, err := runMain(t, append([]string{"--cache-dir=" + filepath.Join(dir, "cache"), "--dry-run"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, _, _ := strings.Cut(out, "\n")
+		return first
+	}
+	for _, tc := range []struct {
+		name     string
+		x, y     []string
+		xIn, yIn string
+	}{
+		{"input-file vs stdin", []string{"--input-file", a, "--", "cat"}, []string{"--stdin", "--", "cat"}, a, a},
+		{"second input-file vs stdin", []string{"--input-file", a, "--input-file", b, "--", "cat"}, []string{"--input-file", a, "--stdin", "--", "cat"}, b, b},
+	} {
+		if x, y := actionID(tc.xIn, tc.x...), actionID(tc.yIn, tc.y...); x == y {
+			t.Errorf("%s: the same %s", tc.name, x)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	cacheDir := t.TempDir()
+	c, err := filecache.Open(cacheDir, filecache.WithCompression(filecache.Zstd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := bytes.Repeat([]byte("shared "), 1024)
+	ids := []filecache.ActionID{filecache.NewActionID([]byte("shared-1")), filecache.NewActionID([]byte("shared-2"))}
+	var out filecache.OutputID
+	for _, id := range ids {
+		if out, err = c.PutBytes(id, shared); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := os.Stat(c.OutputFile(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() >= int64(len(shared)) {
+		t.Fatalf("the data file is not compressed: %d bytes", fi.Size())
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	prune := func(id filecache.ActionID) string {
+		t.Helper()
+		stdout, _, err := runMain(t, "--cache-dir="+cacheDir, "prune", "--key="+base64.URLEncoding.EncodeToString(id[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(stdout)
+	}
+	// The data file is still referenced.
+	if got, want := prune(ids[0]), "pruned 1 entries, reclaimed 0 bytes"; got != want {
+		t.Errorf("first prune: got %q, wanted %q", got, want)
+	}
+	if b, _, err := c.GetBytes(ids[1]); err != nil || !bytes.Equal(b, shared) {
+		t.Fatalf("the other action sharing the output: got %d bytes, %+v", len(b), err)
+	}
+	// The physical, compressed size is reclaimed.
+	if got, want := prune(ids[1]), "pruned 1 entries, reclaimed "+strconv.FormatInt(fi.Size(), 10)+" bytes"; got != want {
+		t.Errorf("second prune: got %q, wanted %q", got, want)
+	}
+	if _, err = os.Stat(c.OutputFile(out)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the data file has not been removed: %+v", err)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// A Codec compresses the data files of the cache.
+type Codec interface {
+	// Name identifies the codec in the header of the data files,
+	// so it must be unique and at most 255 bytes long.
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	// Gzip compresses with compress/gzip.
+	Gzip Codec = gzipCodec{}
+	// Zstd compresses with github.com/klauspost/compress/zstd.
+	Zstd Codec = zstdCodec{}
+
+	codecs = map[string]Codec{Gzip.Name(): Gzip, Zstd.Name(): Zstd}
+)
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string                                  { return "gzip" }
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error)  { return gzip.NewReader(r) }
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string                                  { return "zstd" }
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) }
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// chainCodec applies its codecs in order when writing: the first one
+// gets the plain data, the last one writes to the file.
+type chainCodec []Codec
+
+func (cc chainCodec) Name() string {
+	names := make([]string, len(cc))
+	for i, c := range cc {
+		names[i] = c.Name()
+	}
+	return strings.Join(names, "+")
+}
+
+func (cc chainCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	closers := make(multiCloser, len(cc))
+	for i := len(cc) - 1; i >= 0; i-- {
+		cw, err := cc[i].NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		w, closers[i] = cw, cw
+	}
+	return struct {
+		io.Writer
+		io.Closer
+	}{w, closers}, nil
+}
+
+func (cc chainCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	closers := make(multiCloser, len(cc))
+	for i := len(cc) - 1; i >= 0; i-- {
+		cr, err := cc[i].NewReader(r)
+		if err != nil {
+			closers[i+1:].Close()
+			return nil, err
+		}
+		r, closers[i] = cr, cr
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, closers}, nil
+}
+
+// encoding returns the codec to encode the data files with, nil if none.
+func (C *Cache) encoding() Codec {
+	switch {
+	case C.codec != nil && C.cipher != nil:
+		return chainCodec{C.codec, C.cipher}
+	case C.cipher != nil:
+		return C.cipher
+	}
+	return C.codec
+}
+
+// Encoded data files start with a header:
+//
+//	magic (4 bytes) | length of the codec name (1 byte) | codec name | logical size (8 bytes, big endian)
+//
+// The action entry records the logical (uncompressed) size.
+// An unencrypted encoded data file is only kept if its size differs from that,
+// so an unencrypted data file with the recorded size is always plain.
+const dataMagic = "\x00FCZ"
+
+var errBadHeader = errors.New("bad data file header")
+
+// dataHeader is the parsed header of an encoded data file.
+// The codec is nil for plain data files.
+type dataHeader struct {
+	codec     Codec
+	size      int64
+	encrypted bool
+}
+
+func writeDataHeader(w io.Writer, codec Codec, size int64) (int, error) {
+	name := codec.Name()
+	if len(name) > 255 {
+		return 0, fmt.Errorf("codec name %q is too long", name)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(dataMagic)
+	buf.WriteByte(byte(len(name)))
+	buf.WriteString(name)
+	var a [8]byte
+	binary.BigEndian.PutUint64(a[:], uint64(size))
+	buf.Write(a[:])
+	return w.Write(buf.Bytes())
+}
+
+// readDataHeader reads the header from r,
+// looking up the codecs first in the configured ones, then in the known ones.
+func (C *Cache) readDataHeader(r io.Reader) (dataHeader, error) {
+	var hdr dataHeader
+	var a [len(dataMagic) + 1]byte
+	if _, err := io.ReadFull(r, a[:]); err != nil {
+		return hdr, fmt.Errorf("%w: %w", errBadHeader, err)
+	}
+	if string(a[:len(dataMagic)]) != dataMagic {
+		return hdr, errBadHeader
+	}
+	b := make([]byte, int(a[len(a)-1])+8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return hdr, fmt.Errorf("%w: %w", errBadHeader, err)
+	}
+	var cc chainCodec
+	for _, name := range strings.Split(string(b[:len(b)-8]), "+") {
+		var codec Codec
+		switch {
+		case C.codec != nil && C.codec.Name() == name:
+			codec = C.codec
+		case C.cipher != nil && C.cipher.Name() == name:
+			codec, hdr.encrypted = C.cipher, true
+		case name == (aesGCMCodec{}).Name():
+			return hdr, fmt.Errorf("%w: encrypted data file, but no key is set", ErrAuthentication)
+		default:
+			if codec = codecs[name]; codec == nil {
+				return hdr, fmt.Errorf("%w: unknown codec %q", errBadHeader, name)
+			}
+		}
+		cc = append(cc, codec)
+	}
+	if len(cc) == 1 {
+		hdr.codec = cc[0]
+	} else {
+		hdr.codec = cc
+	}
+	hdr.size = int64(binary.BigEndian.Uint64(b[len(b)-8:]))
+	return hdr, nil
+}
+
+// dataHeader determines whether fh (a data file with the given logical size) is plain or encoded,
+// and reads its header in the latter case.
+func (C *Cache) dataHeader(fh *os.File, size int64) (dataHeader, error) {
+	fi, err := fh.Stat()
+	if err != nil {
+		return dataHeader{}, err
+	}
+	plainSize := fi.Size() == size
+	if plainSize && C.cipher == nil {
+		return dataHeader{}, nil
+	}
+	hdr, err := C.readDataHeader(fh)
+	if err == nil && hdr.size != size {
+		err = fmt.Errorf("%w: size mismatch (header=%d entry=%d)", errBadHeader, hdr.size, size)
+	}
+	if err != nil {
+		if plainSize && errors.Is(err, errBadHeader) {
+			_, err = fh.Seek(0, io.SeekStart)
+			return dataHeader{}, err
+		}
+		return hdr, err
+	}
+	return hdr, nil
+}
+
+// openData opens the data file, returning a reader for its logical content,
+// and its header.
+// If the file is plain, the *os.File itself is returned.
+func (C *Cache) openData(file string, size int64) (io.ReadCloser, dataHeader, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, dataHeader{}, err
+	}
+	hdr, err := C.dataHeader(fh, size)
+	if err != nil {
+		fh.Close()
+		return nil, hdr, err
+	}
+	if hdr.codec == nil {
+		return fh, hdr, nil
+	}
+	dr, err := hdr.codec.NewReader(fh)
+	if err != nil {
+		fh.Close()
+		return nil, hdr, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{dr, multiCloser{dr, fh}}, hdr, nil
+}
+
+type multiCloser []io.Closer
+
+func (mc multiCloser) Close() error {
+	var errs []error
+	for _, c := range mc {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
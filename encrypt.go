@@ -0,0 +1,176 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filecache
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrAuthentication is returned when an encrypted data file cannot be authenticated,
+// most probably because of a wrong key.
+var ErrAuthentication = errors.New("message authentication failed (wrong key?)")
+
+// encChunkSize is the size of the plaintext chunks sealed separately.
+const encChunkSize = 64 << 10
+
+// aesGCMCodec encrypts the stream with AES-256-GCM.
+//
+// The stream starts with a random per-file nonce, followed by the sealed chunks.
+// The nonce of a chunk is the file nonce XOR-ed with the chunk's index,
+// and the last chunk is marked in the additional data, so truncation is detected.
+type aesGCMCodec struct {
+	aead cipher.AEAD
+}
+
+func newAESGCMCodec(key [32]byte) aesGCMCodec {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err) // cannot happen with a 32 byte key
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err) // cannot happen with AES
+	}
+	return aesGCMCodec{aead: aead}
+}
+
+func (aesGCMCodec) Name() string { return "aes256gcm" }
+
+func (c aesGCMCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	sw := &sealWriter{w: w, aead: c.aead, nonce: make([]byte, c.aead.NonceSize()), buf: make([]byte, 0, encChunkSize)}
+	if _, err := rand.Read(sw.nonce); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(sw.nonce); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (c aesGCMCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	or := &openReader{r: bufio.NewReader(r), aead: c.aead, nonce: make([]byte, c.aead.NonceSize())}
+	if _, err := io.ReadFull(or.r, or.nonce); err != nil {
+		return nil, fmt.Errorf("read nonce: %w", err)
+	}
+	return or, nil
+}
+
+// chunkNonce returns the nonce of the i-th chunk.
+func chunkNonce(dst, nonce []byte, i uint64) []byte {
+	dst = append(dst[:0], nonce...)
+	var a [8]byte
+	binary.BigEndian.PutUint64(a[:], i)
+	for j := range a {
+		dst[len(dst)-8+j] ^= a[j]
+	}
+	return dst
+}
+
+var lastChunk, notLastChunk = []byte{1}, []byte{0}
+
+type sealWriter struct {
+	w          io.Writer
+	aead       cipher.AEAD
+	nonce, buf []byte
+	chunkNonce []byte
+	sealed     []byte
+	i          uint64
+	closed     bool
+}
+
+func (sw *sealWriter) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, errors.New("write after close")
+	}
+	var n int
+	for len(p) != 0 {
+		// Seal a full chunk only when more data arrives,
+		// so the last chunk is sealed (as the last one) by Close.
+		if len(sw.buf) == cap(sw.buf) {
+			if err := sw.seal(notLastChunk); err != nil {
+				return n, err
+			}
+		}
+		k := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf = sw.buf[:len(sw.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+func (sw *sealWriter) seal(ad []byte) error {
+	sw.chunkNonce = chunkNonce(sw.chunkNonce, sw.nonce, sw.i)
+	sw.sealed = sw.aead.Seal(sw.sealed[:0], sw.chunkNonce, sw.buf, ad)
+	sw.i++
+	sw.buf = sw.buf[:0]
+	_, err := sw.w.Write(sw.sealed)
+	return err
+}
+
+func (sw *sealWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+	return sw.seal(lastChunk)
+}
+
+type openReader struct {
+	r          *bufio.Reader
+	aead       cipher.AEAD
+	nonce      []byte
+	chunkNonce []byte
+	sealed     []byte
+	buf        []byte
+	i          uint64
+	done       bool
+}
+
+func (or *openReader) Read(p []byte) (int, error) {
+	for len(or.buf) == 0 {
+		if or.done {
+			return 0, io.EOF
+		}
+		if err := or.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, or.buf)
+	or.buf = or.buf[n:]
+	return n, nil
+}
+
+func (or *openReader) open() error {
+	if cap(or.sealed) == 0 {
+		or.sealed = make([]byte, encChunkSize+or.aead.Overhead())
+	}
+	n, err := io.ReadFull(or.r, or.sealed[:cap(or.sealed)])
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	ad := notLastChunk
+	if _, err := or.r.Peek(1); errors.Is(err, io.EOF) {
+		ad, or.done = lastChunk, true
+	}
+	or.chunkNonce = chunkNonce(or.chunkNonce, or.nonce, or.i)
+	if or.buf, err = or.aead.Open(or.sealed[:0], or.chunkNonce, or.sealed[:n], ad); err != nil {
+		return fmt.Errorf("%w: chunk %d: %w", ErrAuthentication, or.i, err)
+	}
+	or.i++
+	return nil
+}
+
+func (or *openReader) Close() error { return nil }
@@ -0,0 +1,211 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filecache
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rogpeppe/go-internal/cache"
+)
+
+// Export writes the entries of the cache to w as a tar archive.
+//
+// The archive has the layout of the cache directory: for each output,
+// the action entries (xx/<action ID>-a) referencing it, each followed by its
+// expiry (xx/<action ID>-e, see PutWithExpiry) if it has one, are followed by
+// the plain (decoded) content of the data file (xx/<output ID>-d).
+//
+// The entries are listed first, by Range, so entries put during
+// the export are not included, and entries removed meanwhile are skipped.
+func (C *Cache) Export(w io.Writer) error {
+	type action struct {
+		id    ActionID
+		entry cache.Entry
+	}
+	byOutput := make(map[OutputID][]action)
+	var outputs []OutputID
+	if err := C.Range(func(id ActionID, entry cache.Entry) bool {
+		if _, ok := byOutput[entry.OutputID]; !ok {
+			outputs = append(outputs, entry.OutputID)
+		}
+		byOutput[entry.OutputID] = append(byOutput[entry.OutputID], action{id: id, entry: entry})
+		return true
+	}); err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for _, out := range outputs {
+		actions := byOutput[out]
+		// All actions reference the same output, any of them will do.
+		rc, entry, err := C.getReader(actions[0].id)
+		if err != nil {
+			if isNotFound(err) || errors.Is(err, ErrCorrupt) {
+				C.logger.Debug("export", "output", fmt.Sprintf("%x", out), "error", err)
+				continue
+			}
+			return err
+		}
+		err = func() error {
+			defer rc.Close()
+			for _, a := range actions {
+				b := []byte(formatIndexEntry(a.id, a.entry.OutputID, a.entry.Size, a.entry.Time.UnixNano()))
+				if err := tw.WriteHeader(&tar.Header{
+					Name: exportName(a.id, "a"), Mode: 0666,
+					Size: int64(len(b)), ModTime: a.entry.Time,
+				}); err != nil {
+					return err
+				}
+				if _, err := tw.Write(b); err != nil {
+					return err
+				}
+				expireAt, err := C.expiry(a.id)
+				if err != nil {
+					return err
+				} else if expireAt.IsZero() {
+					continue
+				}
+				b = []byte(strconv.FormatInt(expireAt.UnixNano(), 10))
+				if err := tw.WriteHeader(&tar.Header{
+					Name: exportName(a.id, "e"), Mode: 0666,
+					Size: int64(len(b)), ModTime: a.entry.Time,
+				}); err != nil {
+					return err
+				}
+				if _, err := tw.Write(b); err != nil {
+					return err
+				}
+			}
+			if err := tw.WriteHeader(&tar.Header{
+				Name: exportName(out, "d"), Mode: 0666,
+				Size: entry.Size, ModTime: entry.Time,
+			}); err != nil {
+				return err
+			}
+			_, err := C.copy(tw, rc)
+			return err
+		}()
+		if err != nil {
+			return fmt.Errorf("export %x: %w", out, err)
+		}
+	}
+	return tw.Close()
+}
+
+// Import reads a tar archive written by Export from r,
+// and puts its entries into the cache.
+//
+// The expiries of the entries are restored, too.
+// Data files whose content does not match their output ID are skipped,
+// with the action entries referencing them.
+func (C *Cache) Import(r io.Reader) error {
+	pending := make(map[OutputID][]ActionID)
+	expiries := make(map[ActionID]time.Time)
+	tr := tar.NewReader(r)
+	for {
+		th, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if th.Typeflag != tar.TypeReg {
+			continue
+		}
+		base := path.Base(th.Name)
+		switch {
+		case strings.HasSuffix(base, "-a"):
+			b, err := io.ReadAll(io.LimitReader(tr, 1<<10))
+			if err != nil {
+				return fmt.Errorf("%s: %w", th.Name, err)
+			}
+			id, entry, err := parseIndexEntry(b)
+			if err != nil {
+				C.logger.Warn("import: skip bad action entry", "name", th.Name, "error", err)
+				continue
+			}
+			pending[entry.OutputID] = append(pending[entry.OutputID], id)
+
+		case strings.HasSuffix(base, "-e"):
+			var id ActionID
+			if n, err := hex.Decode(id[:], []byte(strings.TrimSuffix(base, "-e"))); err != nil || n != len(id) {
+				C.logger.Warn("import: skip bad expiry file name", "name", th.Name, "error", err)
+				continue
+			}
+			b, err := io.ReadAll(io.LimitReader(tr, 1<<10))
+			if err != nil {
+				return fmt.Errorf("%s: %w", th.Name, err)
+			}
+			expireAt, err := parseExpiry(b)
+			if err != nil {
+				C.logger.Warn("import: skip bad expiry", "name", th.Name, "error", err)
+				continue
+			}
+			expiries[id] = expireAt
+
+		case strings.HasSuffix(base, "-d"):
+			var out OutputID
+			if n, err := hex.Decode(out[:], []byte(strings.TrimSuffix(base, "-d"))); err != nil || n != len(out) {
+				C.logger.Warn("import: skip bad data file name", "name", th.Name, "error", err)
+				continue
+			}
+			ids := pending[out]
+			delete(pending, out)
+			if len(ids) == 0 {
+				continue
+			}
+			if err := C.importData(tr, out, ids, expiries); err != nil {
+				if errors.Is(err, ErrCorrupt) {
+					C.logger.Warn("import: skip", "name", th.Name, "error", err)
+					continue
+				}
+				return fmt.Errorf("%s: %w", th.Name, err)
+			}
+		}
+	}
+}
+
+// importData copies r to a temporary file while verifying its hash against out,
+// then puts it as the output of each of the ids, with their expiries.
+func (C *Cache) importData(r io.Reader, out OutputID, ids []ActionID, expiries map[ActionID]time.Time) error {
+	fh, err := os.CreateTemp(C.tempDir, ".import-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+	h := NewHash()
+	if _, err := C.copy(io.MultiWriter(fh, h), r); err != nil {
+		return err
+	}
+	if h.SumOutputID() != out {
+		return fmt.Errorf("%w: content of %x does not match its hash", ErrCorrupt, out)
+	}
+	for _, id := range ids {
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		// A zero expiry means no expiry, as with Put.
+		if _, _, err := C.PutWithExpiry(id, fh, expiries[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportName returns the name of the file of id in the archive, with the layout of the cache.
+func exportName(id [cache.HashSize]byte, key string) string {
+	return fmt.Sprintf("%02x/%x-%s", id[0], id, key)
+}
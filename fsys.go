@@ -0,0 +1,185 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filecache
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rogpeppe/go-internal/cache"
+)
+
+// FS returns a read-only file system view of the cache.
+//
+// It has a single directory (the root, "."), listing the entries of the cache.
+// The file names are the action IDs, encoded with base64.URLEncoding,
+// and the content of a file is the (plain) output of its action.
+//
+// The files are seekable (as http.FileServer needs), so if the data file
+// is compressed or encrypted, Open decodes it as GetFile does.
+func (C *Cache) FS() fs.FS { return cacheFS{C: C} }
+
+type cacheFS struct {
+	C *Cache
+}
+
+var (
+	_ fs.StatFS    = cacheFS{}
+	_ fs.ReadDirFS = cacheFS{}
+)
+
+// actionID decodes the file name into an action ID.
+func (cfs cacheFS) actionID(op, name string) (ActionID, error) {
+	if !fs.ValidPath(name) {
+		return ActionID{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	id, err := DecodeActionID(name)
+	if err != nil {
+		return id, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return id, nil
+}
+
+func (cfs cacheFS) Open(name string) (fs.File, error) {
+	if name == "." {
+		entries, err := cfs.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &dirFile{entries: entries}, nil
+	}
+	id, err := cfs.actionID("open", name)
+	if err != nil {
+		return nil, err
+	}
+	rc, entry, err := cfs.C.GetReader(id)
+	if err == nil {
+		if _, ok := rc.(io.Seeker); !ok {
+			rc.Close()
+			var file string
+			if file, entry, err = cfs.C.GetFile(id); err == nil {
+				rc, err = os.Open(file)
+			}
+		}
+	}
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &fsFile{ReadCloser: rc, info: fileInfo{name: name, entry: entry}}, nil
+}
+
+func (cfs cacheFS) Stat(name string) (fs.FileInfo, error) {
+	if name == "." {
+		return dirInfo{}, nil
+	}
+	id, err := cfs.actionID("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := cfs.C.Get(id)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return fileInfo{name: name, entry: entry}, nil
+}
+
+// ReadDir lists the entries of the cache, sorted by name, for the root directory.
+func (cfs cacheFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		if _, err := cfs.actionID("readdir", name); err != nil {
+			return nil, err
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	var entries []fs.DirEntry
+	if err := cfs.C.Range(func(id ActionID, entry cache.Entry) bool {
+		entries = append(entries, fs.FileInfoToDirEntry(fileInfo{
+			name: base64.URLEncoding.EncodeToString(id[:]), entry: entry,
+		}))
+		return true
+	}); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// pathError wraps err into an *fs.PathError, translating ErrNotFound to fs.ErrNotExist.
+func pathError(op, name string, err error) error {
+	if errors.Is(err, ErrNotFound) {
+		err = fs.ErrNotExist
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// fsFile is an open file of the FS.
+type fsFile struct {
+	io.ReadCloser
+	info fileInfo
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// Seek seeks the underlying data file, which is plain.
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	return f.ReadCloser.(io.Seeker).Seek(offset, whence)
+}
+
+type fileInfo struct {
+	name  string
+	entry cache.Entry
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.entry.Size }
+func (fi fileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi fileInfo) ModTime() time.Time { return fi.entry.Time }
+func (fi fileInfo) IsDir() bool        { return false }
+func (fi fileInfo) Sys() any           { return fi.entry }
+
+// dirFile is the open root directory of the FS.
+type dirFile struct {
+	entries []fs.DirEntry
+	closed  bool
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return dirInfo{}, nil }
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: errors.New("is a directory")}
+}
+func (d *dirFile) Close() error { d.closed = true; return nil }
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: ".", Err: fs.ErrClosed}
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+type dirInfo struct{}
+
+func (dirInfo) Name() string       { return "." }
+func (dirInfo) Size() int64        { return 0 }
+func (dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (dirInfo) ModTime() time.Time { return time.Time{} }
+func (dirInfo) IsDir() bool        { return true }
+func (dirInfo) Sys() any           { return nil }
@@ -0,0 +1,575 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filecache
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// handler serves the cache over HTTP, see Handler.
+type handler struct {
+	C     *Cache
+	fetch func(ctx context.Context, id ActionID) error
+	onPut func(id ActionID)
+	// maxUpload is the maximum size of a POST body, if positive.
+	maxUpload int64
+	// bazel adds the /ac/ and /cas/ endpoints, see WithBazel.
+	bazel bool
+
+	// postsMu guards posts, the POSTs being stored, by action ID.
+	postsMu sync.Mutex
+	posts   map[ActionID]*postCall
+}
+
+// postCall is a POST being stored. Its err is set before done is closed.
+type postCall struct {
+	done chan struct{}
+	err  error
+}
+
+type handlerOption func(*handler)
+
+// WithFetchOnMiss sets the function called by the GET and HEAD requests on a miss,
+// to put the entry into the cache (from an upstream server, for example).
+// If it returns nil, the request is served from the cache.
+func WithFetchOnMiss(fetch func(ctx context.Context, id ActionID) error) handlerOption {
+	return func(h *handler) { h.fetch = fetch }
+}
+
+// WithPutCallback sets a function to be called, in a new goroutine,
+// for each entry stored by a POST request.
+func WithPutCallback(fn func(id ActionID)) handlerOption {
+	return func(h *handler) { h.onPut = fn }
+}
+
+// WithMaxUploadSize limits the size of the body of a POST request to n bytes:
+// above that, it is refused with 413 Request Entity Too Large.
+//
+// Zero means the trim size of the cache (see WithTrimSize), as a larger file
+// would be removed by the next trim anyway; a negative n means no limit.
+func WithMaxUploadSize(n int64) handlerOption {
+	return func(h *handler) { h.maxUpload = n }
+}
+
+// Handler returns an http.Handler serving the cache, on the paths
+//
+//	/<ActionID>    GET, HEAD, POST (store) and DELETE the entry
+//	POST /_batch   GET several entries in one response
+//	GET /_metrics  the metrics, in the Prometheus text exposition format
+//	GET /_healthz  200 OK iff the cache directory is writable
+//	POST /_trim    trim the cache now (regardless of the trim interval), respond with the TrimResult as JSON
+//
+// where the ActionID is base64 (URL) encoded.
+// The paths starting with "/_" are reserved for the non-entry endpoints.
+// (A base64 encoded ActionID may start with "_", but they are always 44 bytes long.)
+//
+// A POST records the Content-Type and the Content-Disposition filename of the request
+// as the Meta of the entry, and GET and HEAD respond with them.
+// A POST body larger than the limit set by WithMaxUploadSize is refused with 413.
+//
+// With WithTracer, the spans of the requests continue the trace of their traceparent header.
+//
+// To mount it under a prefix, use http.StripPrefix.
+// The handler does no authentication: wrap it to restrict /_trim and the write methods.
+func (C *Cache) Handler(options ...handlerOption) http.Handler {
+	h := &handler{C: C, posts: make(map[ActionID]*postCall)}
+	for _, o := range options {
+		o(h)
+	}
+	if h.maxUpload == 0 {
+		h.maxUpload = C.trimSize
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_metrics", h.serveMetrics)
+	mux.HandleFunc("GET /_healthz", h.serveHealthz)
+	mux.HandleFunc("POST /_batch", h.serveBatch)
+	mux.HandleFunc("POST /_trim", h.serveTrim)
+	mux.HandleFunc("/", h.serveEntry)
+	if h.bazel {
+		mux.HandleFunc("GET /ac/{hash}", h.bazelGet(false))
+		mux.HandleFunc("PUT /ac/{hash}", h.bazelPut(false))
+		mux.HandleFunc("GET /cas/{hash}", h.bazelGet(true))
+		mux.HandleFunc("PUT /cas/{hash}", h.bazelPut(true))
+	}
+	if C.tracer == nil {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r.WithContext(traceContext(r)))
+	})
+}
+
+func (h *handler) serveEntry(w http.ResponseWriter, r *http.Request) {
+	actionIDb64 := strings.TrimPrefix(r.URL.Path, "/")
+	logger := h.C.logger.With("actionID", actionIDb64)
+	actionID, err := DecodeActionID(actionIDb64)
+	logger.Debug("handle", "method", r.Method, "path", r.URL.Path, "error", err)
+	if err != nil {
+		logger.Error("decode", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "HEAD":
+		h.head(w, r, logger, actionID)
+	case "GET":
+		h.get(w, r, logger, actionID)
+	case "POST":
+		h.post(w, r, logger, actionID)
+	case "DELETE":
+		h.delete(w, logger, actionID)
+	default:
+		http.Error(w, fmt.Sprintf("%q: only GET, HEAD, POST and DELETE allowed", r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handler) head(w http.ResponseWriter, r *http.Request, logger *slog.Logger, actionID ActionID) {
+	// The same negotiation as get, for the same headers.
+	accept := acceptedCodecs(r.Header.Get("Accept-Encoding"))
+	if r.Header.Get("Range") != "" {
+		accept = nil
+	}
+	rc, codec, entry, sidecars, err := h.C.getEncodedReaderContext(r.Context(), actionID, accept)
+	if h.fetch != nil && errors.Is(err, ErrNotFound) {
+		// The GET following a HEAD will be served locally.
+		if fetchErr := h.fetch(r.Context(), actionID); fetchErr != nil {
+			logger.Info("fetch", "error", fetchErr)
+		} else {
+			rc, codec, entry, sidecars, err = h.C.getEncodedReaderContext(r.Context(), actionID, accept)
+		}
+	}
+	logger.Debug("server HEAD", "entry", entry, "codec", codec, "error", err)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrCorrupt) {
+			code = http.StatusNotFound
+		} else {
+			logger.Error("GetReader", "error", err)
+		}
+		w.WriteHeader(code)
+		return
+	}
+	defer rc.Close()
+	if entry.Size == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	h.setContentHeaders(w, logger, actionID, entry.OutputID, sidecars)
+	w.Header().Add("Vary", "Accept-Encoding")
+	compress := codec == nil && len(accept) != 0
+	if compress {
+		codec = accept[0]
+	}
+	etag := entityTag(entry.OutputID, codec)
+	w.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if codec != nil {
+		w.Header().Set("Content-Encoding", codec.Name())
+		// The length of the compressed on the fly content is not known.
+		if fh, ok := rc.(*os.File); ok && !compress {
+			if n, err := remaining(fh); err == nil {
+				w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+			}
+		}
+	} else {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", entry.Size))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request, logger *slog.Logger, actionID ActionID) {
+	accept := acceptedCodecs(r.Header.Get("Accept-Encoding"))
+	if r.Header.Get("Range") != "" {
+		// Ranges are served from the plain content.
+		accept = nil
+	}
+	rc, codec, entry, sidecars, err := h.C.getEncodedReaderContext(r.Context(), actionID, accept)
+	if h.fetch != nil && errors.Is(err, ErrNotFound) {
+		if fetchErr := h.fetch(r.Context(), actionID); fetchErr != nil {
+			logger.Info("fetch", "error", fetchErr)
+		} else {
+			rc, codec, entry, sidecars, err = h.C.getEncodedReaderContext(r.Context(), actionID, accept)
+		}
+	}
+	logger.Debug("server GET", "entry", entry, "codec", codec, "error", err)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrCorrupt) {
+			logger.Info("not found")
+			code = http.StatusNotFound
+		} else {
+			logger.Error("GetReader", "error", err)
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	defer rc.Close()
+	logger.Info("serve", "length", entry.Size)
+	if entry.Size == 0 {
+		http.Error(w, "zero sized file", http.StatusNotFound)
+		return
+	}
+	h.setContentHeaders(w, logger, actionID, entry.OutputID, sidecars)
+	w.Header().Add("Vary", "Accept-Encoding")
+	// Stored plain, but compressed transfer is accepted: compress on the fly.
+	compress := codec == nil && len(accept) != 0
+	if compress {
+		codec = accept[0]
+	}
+	etag := entityTag(entry.OutputID, codec)
+	w.Header().Set("ETag", etag)
+	if rs, ok := rc.(io.ReadSeeker); ok && codec == nil {
+		// Stored plain: ServeContent handles Range and conditional requests.
+		http.ServeContent(w, r, "", entry.Time, rs)
+		return
+	}
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	dst := io.Writer(w)
+	if compress {
+		cw, err := codec.NewWriter(w)
+		if err != nil {
+			logger.Error("compress", "codec", codec.Name(), "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer cw.Close()
+		dst = cw
+	}
+	if codec != nil {
+		w.Header().Set("Content-Encoding", codec.Name())
+		if fh, ok := rc.(*os.File); ok && !compress {
+			// Stored encoded, passed through: with the length known,
+			// io.Copy can use sendfile(2), as ServeContent does.
+			if n, err := remaining(fh); err == nil {
+				w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+			}
+		}
+	} else {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", entry.Size))
+	}
+	if _, err = io.Copy(dst, rc); err != nil {
+		logger.Error("serving from cached", "error", err)
+	}
+}
+
+// post stores the body as the output of the action ID.
+//
+// The concurrent POSTs of the same action ID are coalesced: only the first one stores,
+// the others wait for it, and succeed with it - or store their own body if it fails.
+func (h *handler) post(w http.ResponseWriter, r *http.Request, logger *slog.Logger, actionID ActionID) {
+	h.postsMu.Lock()
+	call, ok := h.posts[actionID]
+	if !ok {
+		call = &postCall{done: make(chan struct{})}
+		h.posts[actionID] = call
+	}
+	h.postsMu.Unlock()
+	if ok {
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			return
+		}
+		if call.err == nil {
+			logger.Info("stored by a concurrent POST")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		h.store(w, r, logger, actionID)
+		return
+	}
+	call.err = h.store(w, r, logger, actionID)
+	h.postsMu.Lock()
+	delete(h.posts, actionID)
+	h.postsMu.Unlock()
+	close(call.done)
+}
+
+// store stores the body of the POST request, and writes the response.
+// It returns the error iff the body has not been stored.
+func (h *handler) store(w http.ResponseWriter, r *http.Request, logger *slog.Logger, actionID ActionID) error {
+	logger.Info("store")
+	if h.maxUpload > 0 {
+		if r.ContentLength > h.maxUpload {
+			err := &http.MaxBytesError{Limit: h.maxUpload}
+			logger.Error("too large", "length", r.ContentLength, "error", err)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return err
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxUpload)
+	}
+	// Refuse an empty body before storing anything.
+	body := bufio.NewReader(r.Body)
+	if _, err := body.Peek(1); err != nil {
+		if errors.Is(err, io.EOF) {
+			logger.Error("zero-sized file")
+			http.Error(w, "zero-sized file", http.StatusPreconditionFailed)
+		} else {
+			logger.Error("read body", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return err
+	}
+	out, n, err := h.C.putReaderContext(r.Context(), actionID, body)
+	logger.Info("put", "length", n, "error", err)
+	if err != nil {
+		logger.Error("Put", "error", err)
+		code := http.StatusInternalServerError
+		var tooLarge *http.MaxBytesError
+		if errors.Is(err, ErrNoSpace) {
+			code = http.StatusInsufficientStorage
+		} else if errors.As(err, &tooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), code)
+		return err
+	}
+	if meta := requestMeta(r); meta != (Meta{}) {
+		if err := h.C.putMeta(actionID, out, meta); err != nil {
+			logger.Warn("put meta", "meta", meta, "error", err)
+		}
+	}
+	if h.onPut != nil {
+		go h.onPut(actionID)
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// setContentHeaders sets the Content-Type, and the Content-Disposition (if there is a file name)
+// headers from the Meta of the entry - read only if the entry has sidecars.
+func (h *handler) setContentHeaders(w http.ResponseWriter, logger *slog.Logger, actionID ActionID, out OutputID, sidecars bool) {
+	var meta Meta
+	if sidecars {
+		var err error
+		if meta, err = h.C.getMeta(actionID, out); err != nil {
+			logger.Warn("get meta", "error", err)
+		}
+	}
+	w.Header().Set("Content-Type", cmp.Or(meta.ContentType, "application/octet-stream"))
+	if meta.FileName != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": meta.FileName}))
+	}
+}
+
+// requestMeta returns the Meta of the POSTed content,
+// from the Content-Type and the Content-Disposition (filename) headers.
+func requestMeta(r *http.Request) Meta {
+	var meta Meta
+	if ct := r.Header.Get("Content-Type"); ct != "application/octet-stream" {
+		meta.ContentType = ct
+	}
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		meta.FileName = path.Base(params["filename"])
+	}
+	return meta
+}
+
+func (h *handler) delete(w http.ResponseWriter, logger *slog.Logger, actionID ActionID) {
+	ok, err := h.C.Has(actionID)
+	if err == nil && ok {
+		err = h.C.Delete(actionID)
+	}
+	logger.Info("delete", "found", ok, "error", err)
+	if err != nil {
+		logger.Error("Delete", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	// The cache is usable iff its directory is writable.
+	fh, err := os.CreateTemp(h.C.dir, ".healthz-*")
+	if err == nil {
+		_, err = fh.Write([]byte("ok"))
+		if closeErr := fh.Close(); err == nil {
+			err = closeErr
+		}
+		_ = os.Remove(fh.Name())
+	}
+	if err != nil {
+		h.C.logger.Error("healthz", "error", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (h *handler) serveTrim(w http.ResponseWriter, r *http.Request) {
+	h.C.trimMu.Lock()
+	res, err := h.C.trim(true)
+	h.C.trimUnlock()
+	h.C.logger.Info("trim", "scanned", res.ScannedFiles, "removed", res.RemovedFiles, "removedBytes", res.RemovedBytes, "duration", res.Duration.String(), "error", err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// serveMetrics writes the metrics of the cache in the Prometheus text exposition format.
+func (h *handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	// The sizes are those of the last trim: a walk of the cache (Stats) on each scrape would be too costly.
+	m := h.C.Metrics()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, x := range []struct {
+		name, typ, help string
+		value           float64
+	}{
+		{"filecache_hits_total", "counter", "Number of cache hits.", float64(m.Hits)},
+		{"filecache_misses_total", "counter", "Number of cache misses.", float64(m.Misses)},
+		{"filecache_puts_total", "counter", "Number of stored entries.", float64(m.Puts)},
+		{"filecache_evictions_total", "counter", "Number of data files removed by trim.", float64(m.Evictions)},
+		{"filecache_served_bytes_total", "counter", "Size of the served entries.", float64(m.BytesServed)},
+		{"filecache_trim_duration_seconds_total", "counter", "Time spent trimming.", m.TrimDuration.Seconds()},
+		{"filecache_size_bytes", "gauge", "Total size of the cache files on disk, as of the last trim.", float64(m.Size)},
+		{"filecache_files", "gauge", "Number of the data files, as of the last trim.", float64(m.Count)},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", x.name, x.help, x.name, x.typ, x.name, x.value)
+	}
+}
+
+// maxBatch is the maximal number of action IDs in one /_batch request.
+const maxBatch = 10_000
+
+// serveBatch answers a POST /_batch request: its body is a newline separated list
+// of base64 (URL encoding) ActionIDs, and the response is for each ActionID, in order,
+//
+//	<base64 ActionID> <size>\n<size bytes of data>
+//
+// for the found entries, and
+//
+//	<base64 ActionID> -1\n
+//
+// for the misses (including the malformed IDs), so a miss does not abort the batch.
+func (h *handler) serveBatch(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			ids = append(ids, line)
+		}
+		if len(ids) > maxBatch {
+			http.Error(w, fmt.Sprintf("at most %d IDs are allowed", maxBatch), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger := h.C.logger
+	w.Header().Set("Content-Type", "application/x-filecache-batch")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	for _, actionIDb64 := range ids {
+		actionID, err := DecodeActionID(actionIDb64)
+		if err != nil {
+			logger.Info("batch: bad ID", "actionID", actionIDb64, "error", err)
+			fmt.Fprintf(bw, "%s -1\n", actionIDb64)
+			continue
+		}
+		rc, entry, err := h.C.getReaderContext(r.Context(), actionID)
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrCorrupt) {
+				logger.Error("batch: GetReader", "actionID", actionIDb64, "error", err)
+			}
+			fmt.Fprintf(bw, "%s -1\n", actionIDb64)
+			continue
+		}
+		fmt.Fprintf(bw, "%s %d\n", actionIDb64, entry.Size)
+		n, err := io.Copy(bw, rc)
+		rc.Close()
+		if err != nil || n != entry.Size {
+			// The framing is broken, the client must see the truncated response.
+			logger.Error("batch: copy", "actionID", actionIDb64, "size", entry.Size, "written", n, "error", err)
+			return
+		}
+	}
+}
+
+// remaining returns the number of bytes from the current offset till the end of fh.
+func remaining(fh *os.File) (int64, error) {
+	fi, err := fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+	off, err := fh.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size() - off, nil
+}
+
+// entityTag returns the ETag of the content with the output ID (a hash of the plain content),
+// encoded with codec (if not nil).
+func entityTag(out OutputID, codec Codec) string {
+	if codec == nil {
+		return fmt.Sprintf(`"%x"`, out)
+	}
+	return fmt.Sprintf(`"%x-%s"`, out, codec.Name())
+}
+
+// etagMatch reports whether the If-None-Match header matches the etag.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		if t = strings.TrimPrefix(strings.TrimSpace(t), "W/"); t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// transferCodecs are the codecs usable as Content-Encoding, in the order of preference.
+var transferCodecs = []Codec{Zstd, Gzip}
+
+// acceptedCodecs returns the transfer codecs accepted by the Accept-Encoding header,
+// in the order of preference.
+func acceptedCodecs(acceptEncoding string) []Codec {
+	var accept []Codec
+	for _, c := range transferCodecs {
+		for _, part := range strings.Split(acceptEncoding, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			if strings.TrimSpace(name) != c.Name() {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					break
+				}
+			}
+			accept = append(accept, c)
+			break
+		}
+	}
+	return accept
+}
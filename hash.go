@@ -6,7 +6,11 @@ package filecache
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
 	"hash"
+	"io"
+	"os"
+	"slices"
 )
 
 const HashSize = sha256.Size
@@ -20,8 +24,103 @@ type Hash struct {
 }
 
 func NewHash() Hash { return Hash{Hash: sha256.New()} }
+
+// HashWith returns a Hash using the given hash function instead of SHA-256.
+//
+// The IDs are HashSize bytes long, so a longer digest is truncated,
+// a shorter one is zero padded by SumID.
+func HashWith(h func() hash.Hash) Hash { return Hash{Hash: h()} }
+
 func (h Hash) SumID() ID {
 	var a ID
-	h.Hash.Sum(a[:0])
+	copy(a[:], h.Hash.Sum(nil))
 	return a
 }
+
+// SumActionID returns the sum as an ActionID.
+// ID, ActionID and OutputID have the same size, so no truncation happens.
+func (h Hash) SumActionID() ActionID { return ActionID(h.SumID()) }
+
+// SumOutputID returns the sum as an OutputID, the key of the content hashed.
+func (h Hash) SumOutputID() OutputID { return OutputID(h.SumID()) }
+
+// ActionHasher builds an ActionID incrementally, without assembling the whole key in memory.
+//
+// AddString and AddBytes (and Write) add the bytes as is, AddFile and AddReader
+// add the ID (hash) of the content, so each of them adds exactly HashSize bytes.
+type ActionHasher struct {
+	h Hash
+}
+
+func NewActionHasher() *ActionHasher { return &ActionHasher{h: NewHash()} }
+
+func (ah *ActionHasher) Write(p []byte) (int, error) { return ah.h.Write(p) }
+func (ah *ActionHasher) AddString(s string)          { _, _ = io.WriteString(ah.h, s) }
+func (ah *ActionHasher) AddBytes(p []byte)           { _, _ = ah.h.Write(p) }
+
+// AddReader adds the ID of the content of r.
+func (ah *ActionHasher) AddReader(r io.Reader) error {
+	h := NewHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	id := h.SumID()
+	ah.AddBytes(id[:])
+	return nil
+}
+
+// AddFile adds the ID of the content of the file.
+func (ah *ActionHasher) AddFile(path string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return ah.AddReader(fh)
+}
+
+func (ah *ActionHasher) ActionID() ActionID { return ah.h.SumActionID() }
+
+// HashReader passes the reads through from the underlying reader, while hashing them.
+type HashReader struct {
+	r io.Reader
+	h Hash
+}
+
+func NewHashReader(r io.Reader) *HashReader { return &HashReader{r: r, h: NewHash()} }
+
+func (hr *HashReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	_, _ = hr.h.Write(p[:n])
+	return n, err
+}
+
+// SumID returns the hash of the content read so far, of the whole stream after EOF.
+func (hr *HashReader) SumID() ID { return hr.h.SumID() }
+
+// Rendezvous orders the nodes by their rendezvous (highest random weight) hash for the action ID,
+// returning their indices, the owner of the action ID first.
+//
+// Each node's weight depends only on its name and the action ID, so adding or removing
+// a node moves only the action IDs owned by that node.
+func Rendezvous(id ActionID, nodes []string) []int {
+	weights := make([]uint64, len(nodes))
+	order := make([]int, len(nodes))
+	for i, node := range nodes {
+		h := sha256.New()
+		_, _ = io.WriteString(h, node)
+		_, _ = h.Write(id[:])
+		weights[i] = binary.BigEndian.Uint64(h.Sum(nil))
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		switch {
+		case weights[a] > weights[b]:
+			return -1
+		case weights[a] < weights[b]:
+			return 1
+		}
+		return 0
+	})
+	return order
+}
@@ -0,0 +1,140 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filecache
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/renameio/v2"
+)
+
+// Meta is the metadata of a cache entry.
+//
+// It is stored in a sidecar file (xxxx-m) next to the action entry,
+// and it belongs to the output it was stored with:
+// if the action is put again with another output, its Meta is gone.
+type Meta struct {
+	// ContentType is the MIME type of the content.
+	ContentType string `json:"contentType,omitempty"`
+	// FileName is the original name of the file.
+	FileName string `json:"fileName,omitempty"`
+}
+
+// metaFile is the content of the sidecar file.
+type metaFile struct {
+	Meta
+	OutputID string `json:"outputID"`
+}
+
+// PutWithMeta is like Put, but records meta for the entry, too.
+func (C *Cache) PutWithMeta(id ActionID, file io.ReadSeeker, meta Meta) (out OutputID, n int64, err error) {
+	_, span := C.startSpan(context.Background(), "filecache.PutWithMeta", id)
+	defer func() { endSpan(span, err, n) }()
+	C.maybeTrim()
+	return C.retryNoSpace(func() (OutputID, int64, error) {
+		mu := C.shard(id)
+		mu.Lock()
+		defer mu.Unlock()
+		out, n, err := C.put(id, file)
+		if err != nil {
+			return out, n, err
+		}
+		if err = C.setExpiry(id, time.Time{}); err != nil {
+			return out, n, err
+		}
+		return out, n, C.setMeta(id, out, meta)
+	})
+}
+
+// GetMeta returns the metadata of the entry of the action ID,
+// the zero Meta if it has been stored without one.
+// The error wraps ErrNotFound if there is no such entry.
+func (C *Cache) GetMeta(id ActionID) (Meta, error) {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	entry, sidecars, err := C.entry(id)
+	if err != nil || !sidecars {
+		return Meta{}, err
+	}
+	return C.getMeta(id, entry.OutputID)
+}
+
+// putMeta records meta for the entry of the action ID, stored with output out.
+func (C *Cache) putMeta(id ActionID, out OutputID, meta Meta) error {
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	return C.setMeta(id, out, meta)
+}
+
+// setMeta writes the metadata sidecar of the action ID,
+// or removes it when meta is zero.
+func (C *Cache) setMeta(id ActionID, out OutputID, meta Meta) error {
+	fn := C.fileName(id, "m")
+	if meta == (Meta{}) {
+		if err := os.Remove(fn); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(metaFile{Meta: meta, OutputID: hex.EncodeToString(out[:])})
+	if err != nil {
+		return err
+	}
+	if err = renameio.WriteFile(fn, b, 0666); err != nil {
+		return err
+	}
+	return C.markSidecars(id)
+}
+
+// getMeta reads the metadata sidecar of the action ID,
+// returning the zero Meta if there is none for the output out.
+func (C *Cache) getMeta(id ActionID, out OutputID) (Meta, error) {
+	b, err := os.ReadFile(C.fileName(id, "m"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Meta{}, nil
+		}
+		return Meta{}, err
+	}
+	var mf metaFile
+	if err := json.Unmarshal(b, &mf); err != nil {
+		C.logger.Warn("parse meta", "actionID", fmt.Sprintf("%x", id), "error", err)
+		return Meta{}, nil
+	}
+	if mf.OutputID != hex.EncodeToString(out[:]) {
+		return Meta{}, nil
+	}
+	return mf.Meta, nil
+}
+
+// trimMeta removes the metadata file (xxxx-m) if its entry is gone,
+// or flags the entry to have sidecars (for the caches written before the flag).
+func (C *Cache) trimMeta(name string) {
+	var id ActionID
+	b, err := hex.DecodeString(strings.TrimSuffix(name, "-m"))
+	if err != nil || len(b) != len(id) {
+		return
+	}
+	copy(id[:], b)
+	mu := C.shard(id)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, err := os.Stat(C.fileName(id, "a")); os.IsNotExist(err) {
+		_ = os.Remove(C.fileName(id, "m"))
+	} else if err == nil {
+		_ = C.markSidecars(id)
+	}
+}
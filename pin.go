@@ -0,0 +1,70 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filecache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Acquire is like GetFile, but pins the entry of the action ID till release is called:
+// trim (and the size or count based eviction) skips the action and data files
+// (and the uncompressed copy) of a pinned entry, so path stays openable.
+//
+// The pins are reference counted, so the entry is pinned till all its releases are called.
+// release is idempotent.
+//
+// The pins are per-process, kept in memory only: they do not protect the entry
+// against the trims of other processes sharing the cache directory, nor against Delete or Clear.
+func (C *Cache) Acquire(id ActionID) (path string, release func(), err error) {
+	path, _, err = C.GetFile(id)
+	if err != nil {
+		return "", nil, err
+	}
+	names := []string{filepath.Base(C.fileName(id, "a")), filepath.Base(path)}
+	C.pin(names)
+	var once sync.Once
+	release = func() { once.Do(func() { C.unpin(names) }) }
+	// A concurrent trim may have removed the files before they were pinned.
+	if _, err = os.Stat(path); err != nil {
+		release()
+		return "", nil, fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return path, release, nil
+}
+
+// errPinned is returned by evict for the files of the entries pinned by Acquire.
+var errPinned = errors.New("pinned")
+
+func (C *Cache) pin(names []string) {
+	C.pinsMu.Lock()
+	defer C.pinsMu.Unlock()
+	if C.pins == nil {
+		C.pins = make(map[string]int)
+	}
+	for _, name := range names {
+		C.pins[name]++
+	}
+}
+
+func (C *Cache) unpin(names []string) {
+	C.pinsMu.Lock()
+	defer C.pinsMu.Unlock()
+	for _, name := range names {
+		if C.pins[name]--; C.pins[name] <= 0 {
+			delete(C.pins, name)
+		}
+	}
+}
+
+// pinned reports whether the cache file (xxxx-a, xxxx-d, or the uncompressed copy) is pinned.
+func (C *Cache) pinned(path string) bool {
+	C.pinsMu.Lock()
+	defer C.pinsMu.Unlock()
+	return C.pins[filepath.Base(path)] > 0
+}
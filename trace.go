@@ -0,0 +1,70 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filecache
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithTracer sets the tracer to start the spans of the Get*, Put* and Trim calls with.
+//
+// The spans have the (hex) ActionID, the number of bytes, and for the Get* calls,
+// whether it is a hit, as attributes.
+// Without a tracer, no span is started.
+func WithTracer(tracer trace.Tracer) cacheOption {
+	return func(C *Cache) { C.tracer = tracer }
+}
+
+// startSpan starts the span of the operation on the action ID, iff there is a tracer.
+// A zero id is not recorded.
+func (C *Cache) startSpan(ctx context.Context, name string, id ActionID) (context.Context, trace.Span) {
+	if C.tracer == nil {
+		return ctx, nil
+	}
+	var opts []trace.SpanStartOption
+	if id != (ActionID{}) {
+		opts = append(opts, trace.WithAttributes(attribute.String("filecache.action_id", hex.EncodeToString(id[:]))))
+	}
+	return C.tracer.Start(ctx, name, opts...)
+}
+
+// endSpan ends the span (if not nil), recording the size and the error.
+func endSpan(span trace.Span, err error, size int64) {
+	if span == nil {
+		return
+	}
+	span.SetAttributes(attribute.Int64("filecache.bytes", size))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endGetSpan is endSpan for a lookup, recording whether it is a hit.
+// A miss is not an error of the span.
+func endGetSpan(span trace.Span, err error, size int64) {
+	if span == nil {
+		return
+	}
+	span.SetAttributes(attribute.Bool("filecache.hit", err == nil))
+	if errors.Is(err, ErrNotFound) {
+		err = nil
+	}
+	endSpan(span, err, size)
+}
+
+// traceContext returns the context of the request, continuing the trace of its traceparent header.
+func traceContext(r *http.Request) context.Context {
+	return propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
@@ -0,0 +1,224 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filecache
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rogpeppe/go-internal/cache"
+)
+
+// VerifyResult is the outcome of Verify.
+type VerifyResult struct {
+	// Scanned is the number of the cache files (xxxx-a, xxxx-d, xxxx-e and xxxx-m) looked at.
+	Scanned int
+	// OK is the number of the data files with the content their name (OutputID) says.
+	OK int
+	// Corrupt is the number of the data files with another content, and of the unparsable action entries.
+	Corrupt int
+	// Orphan is the number of the data files without an action entry,
+	// and of the action entries (and their sidecars) without a data file.
+	Orphan int
+	// Problems lists the corrupt and orphan files.
+	Problems []VerifyProblem
+}
+
+// VerifyProblem is a corrupt or orphan file found by Verify.
+type VerifyProblem struct {
+	Path string
+	// Kind is "corrupt" or "orphan".
+	Kind string
+	Err  error
+	// Removed reports whether the file has been removed (with its entries).
+	Removed bool
+}
+
+// verifyGrace is the age below which orphans are left alone, as they may belong to a Put in progress.
+const verifyGrace = time.Minute
+
+// Verify walks the cache, re-hashing each data file (xxxx-d) and comparing it to its OutputID,
+// and looks for the orphans: data files without an action entry (xxxx-a) and vice versa.
+//
+// With repair, the problems found are removed: a corrupt data file with the action entries
+// pointing to it. Files failing authentication (see WithEncryption) are never removed,
+// as that may be just the wrong key.
+func (C *Cache) Verify(repair bool) (VerifyResult, error) {
+	C.trimMu.Lock()
+	defer C.trimUnlock()
+	cutoff := C.now().Add(-verifyGrace)
+
+	var res VerifyResult
+	problem := func(path, kind string, err error, remove func() error) {
+		p := VerifyProblem{Path: path, Kind: kind, Err: err}
+		if repair && remove != nil {
+			if rErr := remove(); rErr != nil {
+				C.logger.Warn("verify: remove", "path", path, "error", rErr)
+			} else {
+				p.Removed = true
+			}
+		}
+		res.Problems = append(res.Problems, p)
+		if kind == "corrupt" {
+			res.Corrupt++
+		} else {
+			res.Orphan++
+		}
+	}
+	deleteIDs := func(ids ...ActionID) func() error {
+		return func() error {
+			var errs []error
+			for _, id := range ids {
+				mu := C.shard(id)
+				mu.Lock()
+				errs = append(errs, C.delete(id))
+				mu.Unlock()
+			}
+			return errors.Join(errs...)
+		}
+	}
+
+	type cacheFile struct {
+		path    string
+		modTime time.Time
+		entry   cache.Entry
+	}
+	data := make(map[OutputID]cacheFile)
+	entries := make(map[ActionID]cacheFile)
+	refs := make(map[OutputID][]ActionID)
+	var sidecars []string
+	for i := 0; i < 256; i++ {
+		subdir := filepath.Join(C.dir, fmt.Sprintf("%02x", i))
+		dis, err := os.ReadDir(subdir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return res, err
+		}
+		for _, di := range dis {
+			name := di.Name()
+			path := filepath.Join(subdir, name)
+			switch {
+			case strings.HasSuffix(name, "-a"):
+				res.Scanned++
+				b, err := os.ReadFile(path)
+				if err != nil {
+					if os.IsNotExist(err) {
+						continue
+					}
+					return res, err
+				}
+				id, entry, err := parseIndexEntry(b)
+				if err != nil {
+					problem(path, "corrupt", err, func() error { return os.Remove(path) })
+					continue
+				}
+				fi, err := di.Info()
+				if err != nil {
+					continue
+				}
+				entries[id] = cacheFile{path: path, modTime: fi.ModTime(), entry: entry}
+				refs[entry.OutputID] = append(refs[entry.OutputID], id)
+			case strings.HasSuffix(name, "-d"):
+				res.Scanned++
+				var out OutputID
+				b, err := hex.DecodeString(strings.TrimSuffix(name, "-d"))
+				if err != nil || len(b) != len(out) {
+					problem(path, "orphan", errors.New("not an OutputID"), nil)
+					continue
+				}
+				copy(out[:], b)
+				fi, err := di.Info()
+				if err != nil {
+					continue
+				}
+				data[out] = cacheFile{path: path, modTime: fi.ModTime()}
+			case strings.HasSuffix(name, "-e") || strings.HasSuffix(name, "-m"):
+				res.Scanned++
+				sidecars = append(sidecars, path)
+			}
+		}
+	}
+
+	for out, df := range data {
+		ids := refs[out]
+		if len(ids) == 0 {
+			if df.modTime.Before(cutoff) {
+				problem(df.path, "orphan", errors.New("no action entry"), func() error { return os.Remove(df.path) })
+			}
+			continue
+		}
+		if err := C.verifyData(df.path, out, entries[ids[0]].entry.Size); err != nil {
+			remove := deleteIDs(ids...)
+			if errors.Is(err, ErrAuthentication) {
+				remove = nil
+			}
+			problem(df.path, "corrupt", err, remove)
+			continue
+		}
+		res.OK++
+	}
+	for out, ids := range refs {
+		if _, ok := data[out]; ok {
+			continue
+		}
+		for _, id := range ids {
+			if af := entries[id]; af.modTime.Before(cutoff) {
+				problem(af.path, "orphan", errors.New("no data file"), deleteIDs(id))
+			}
+		}
+	}
+	for _, path := range sidecars {
+		name := filepath.Base(path)
+		var id ActionID
+		b, err := hex.DecodeString(name[:len(name)-2])
+		if err != nil || len(b) != len(id) {
+			continue
+		}
+		copy(id[:], b)
+		if _, ok := entries[id]; ok {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().Before(cutoff) {
+			problem(path, "orphan", errors.New("no action entry"), func() error {
+				if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return err
+				}
+				return nil
+			})
+		}
+	}
+	slices.SortFunc(res.Problems, func(a, b VerifyProblem) int { return strings.Compare(a.Path, b.Path) })
+	return res, nil
+}
+
+// verifyData checks that the (decoded) content of the data file hashes to out.
+func (C *Cache) verifyData(path string, out OutputID, size int64) error {
+	rc, _, err := C.openData(path, size)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	h := NewHash()
+	n, err := C.copy(h, rc)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("%w: size mismatch: got %d, wanted %d", ErrCorrupt, n, size)
+	}
+	if h.SumOutputID() != out {
+		return fmt.Errorf("%w: content mismatch", ErrCorrupt)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2026 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Fetcher returns the content of the output of the action,
+// or an error wrapping ErrNotFound if it does not have it.
+type Fetcher func(ctx context.Context, id ActionID) (io.ReadCloser, error)
+
+// WarmStatus is the outcome of Warm for an action ID.
+type WarmStatus uint8
+
+const (
+	// WarmPresent is an entry already in the cache.
+	WarmPresent WarmStatus = iota
+	// WarmFetched is an entry missing from the cache, stored from the source.
+	WarmFetched
+	// WarmMissing is an entry neither in the cache, nor in the source.
+	WarmMissing
+	// WarmFailed is an entry looking up or fetching of which failed, see WarmResult.Err.
+	WarmFailed
+)
+
+func (s WarmStatus) String() string {
+	switch s {
+	case WarmPresent:
+		return "present"
+	case WarmFetched:
+		return "fetched"
+	case WarmMissing:
+		return "missing"
+	case WarmFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("WarmStatus(%d)", uint8(s))
+}
+
+// WarmResult is the outcome of Warm for an action ID.
+type WarmResult struct {
+	ID     ActionID
+	Status WarmStatus
+	// Err is the error of a WarmFailed entry.
+	Err error
+}
+
+// warmWorkers is the number of the entries Warm processes concurrently.
+const warmWorkers = 16
+
+// Warm ensures that the entries of the action IDs are present in the cache,
+// by opening their data files, and storing the missing ones from source (if not nil),
+// warmWorkers of them concurrently.
+//
+// It returns the results in the order of ids, and the errors of the failed entries joined,
+// or ctx.Err() if ctx is cancelled - the entries not processed then are WarmFailed.
+func (C *Cache) Warm(ctx context.Context, ids []ActionID, source Fetcher) ([]WarmResult, error) {
+	results := make([]WarmResult, len(ids))
+	// Each worker writes distinct elements of results.
+	todo := make(chan int)
+	var wg sync.WaitGroup
+	for w := min(warmWorkers, len(ids)); w > 0; w-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				results[i] = C.warm(ctx, ids[i], source)
+			}
+		}()
+	}
+	for i := range ids {
+		todo <- i
+	}
+	close(todo)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return results, err
+	}
+	var errs []error
+	for _, res := range results {
+		if res.Err != nil {
+			errs = append(errs, fmt.Errorf("%x: %w", res.ID, res.Err))
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// warm is Warm for a single action ID.
+func (C *Cache) warm(ctx context.Context, id ActionID, source Fetcher) WarmResult {
+	res := WarmResult{ID: id}
+	if res.Err = ctx.Err(); res.Err != nil {
+		res.Status = WarmFailed
+		return res
+	}
+	mu := C.shard(id)
+	mu.Lock()
+	_, _, _, _, err := C.lookup(id)
+	mu.Unlock()
+	if err == nil {
+		res.Status = WarmPresent
+		return res
+	}
+	if errors.Is(err, ErrNotFound) && source != nil {
+		var fetched bool
+		if fetched, err = C.storeFrom(ctx, id, source); err == nil {
+			res.Status = WarmPresent
+			if fetched {
+				res.Status = WarmFetched
+			}
+			return res
+		}
+	}
+	if errors.Is(err, ErrNotFound) {
+		res.Status = WarmMissing
+	} else {
+		res.Status, res.Err = WarmFailed, err
+	}
+	return res
+}